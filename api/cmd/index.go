@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/zmb3/spotify"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"versefind/pkg"
+)
+
+func init() {
+	indexCmd.Flags().StringVar(&trackListFormat, "format", "", "the track list format, json or csv (default: inferred from the file extension)")
+	rootCmd.AddCommand(indexCmd)
+}
+
+var (
+	trackListFormat string
+
+	indexCmd = &cobra.Command{
+		Use:   "index FILE",
+		Short: "Index the lyrics of a list of tracks",
+		Long: "Index the lyrics of a list of tracks without a browser session, for example to pre-warm the shared " +
+			"tracks index. FILE is a JSON or CSV list of Spotify track IDs or artist/title pairs, or - for standard input.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format := trackListFormat
+			if format == "" {
+				format = strings.TrimPrefix(strings.ToLower(filepath.Ext(args[0])), ".")
+			}
+			var reader io.Reader = os.Stdin
+			if args[0] != "-" {
+				file, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer func() { _ = file.Close() }()
+				reader = file
+			}
+			refs, err := pkg.ReadTrackRefs(reader, format)
+			if err != nil {
+				return err
+			}
+
+			client, err := pkg.NewAppClient(context.Background())
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			_, _ = fmt.Fprintf(out, "resolving %d tracks with spotify\n", len(refs))
+			tracks, err := pkg.ResolveTracks(client, refs)
+			if err != nil {
+				return err
+			}
+
+			var found []spotify.FullTrack
+			missing := 0
+			for idx, track := range tracks {
+				if track == nil {
+					missing++
+					_, _ = fmt.Fprintf(out, "%s: not found on spotify\n", refs[idx])
+					continue
+				}
+				found = append(found, *track)
+			}
+
+			instrumentals := pkg.DetectInstrumentals(client, found)
+			progress := newTrackProgress(out, len(found), "indexed")
+			pkg.IndexTracks(context.Background(), found, instrumentals, progress.report)
+			_, _ = fmt.Fprintf(out, "indexed %d tracks, %d failed, %d not found on spotify\n", progress.succeeded, progress.failed, missing)
+			return nil
+		},
+	}
+)
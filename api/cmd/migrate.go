@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"versefind/pkg"
+)
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateDeleteOld, "delete-old", false, "delete the previous tracks index once the migration completes")
+	rootCmd.AddCommand(migrateCmd)
+}
+
+var (
+	migrateDeleteOld bool
+
+	migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade the Elasticsearch tracks index to the current layout",
+		Long: "Create a tracks index with the current mappings and analyzers, copy every indexed track into it and " +
+			"atomically switch the tracks alias to it. A running server keeps serving searches throughout, and no lyrics " +
+			"are scraped again. Writes are blocked while the tracks stored during the copy are copied again, so tracks " +
+			"indexed in that time are looked up again later. The previous index is left read-only unless --delete-old is " +
+			"given.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			elasticStore, ok := trackStore.(*pkg.ElasticStore)
+			if !ok {
+				return fmt.Errorf("migrations are only supported by the elastic track store")
+			}
+			out := cmd.OutOrStdout()
+			err := elasticStore.Migrate(context.Background(), migrateDeleteOld, func(step string) {
+				_, _ = fmt.Fprintln(out, step)
+			})
+			if errors.Is(err, pkg.ErrAlreadyMigrated) {
+				_, _ = fmt.Fprintln(out, "the tracks index is already up to date")
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintln(out, "migration complete")
+			return nil
+		},
+	}
+)
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"versefind/pkg"
+)
+
+func init() {
+	playlistCmd.Flags().StringVar(&playlistServer, "server", "http://127.0.0.1:3001", "the address of the running versefind server through which the playlist is written")
+	playlistCmd.Flags().StringVar(&playlistSession, "session", "", "the id of the user session whose library is searched and to whose account the playlist belongs")
+	playlistCmd.Flags().StringVar(&playlistName, "name", "", "the name of a new playlist to create")
+	playlistCmd.Flags().StringVar(&playlistID, "playlist", "", "the ID, URI or link of an existing playlist to add to")
+	playlistCmd.Flags().BoolVar(&playlistReplace, "replace", false, "remove the existing tracks of the playlist first")
+	playlistCmd.Flags().BoolVar(&playlistPublic, "public", false, "make a new playlist public")
+	playlistCmd.Flags().StringVar(&playlistMode, "mode", pkg.SearchModeQuery, fmt.Sprintf("how QUERY is interpreted (one of %s)", strings.Join(pkg.SearchModes, ", ")))
+	playlistCmd.Flags().StringSliceVar(&playlistSources, "source", nil, "only include tracks found in these parts of the user's library, such as saved or playlist:<id>")
+	_ = playlistCmd.MarkFlagRequired("session")
+	rootCmd.AddCommand(playlistCmd)
+}
+
+var (
+	playlistServer  string
+	playlistSession string
+	playlistName    string
+	playlistID      string
+	playlistReplace bool
+	playlistPublic  bool
+	playlistMode    string
+	playlistSources []string
+
+	playlistCmd = &cobra.Command{
+		Use:   "playlist QUERY",
+		Short: "Write every track in a user's library matching a search to a Spotify playlist",
+		Long: "Search the indexed tracks of a user's library and write every match, up to the size limit of a " +
+			"playlist, to a new playlist named with --name or an existing playlist given with --playlist. The user is " +
+			"identified by the id of a session of the running server given with --server, which writes the playlist " +
+			"through its /api/playlist endpoint.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (playlistName == "") == (playlistID == "") {
+				return fmt.Errorf("exactly one of --name and --playlist is required")
+			}
+			if !pkg.IsSearchMode(playlistMode) {
+				return fmt.Errorf("unknown search mode %s", playlistMode)
+			}
+			params := url.Values{}
+			params.Set("q", strings.Join(args, " "))
+			params.Set("mode", playlistMode)
+			params.Set("name", playlistName)
+			params.Set("playlist", playlistID)
+			params.Set("replace", strconv.FormatBool(playlistReplace))
+			params.Set("public", strconv.FormatBool(playlistPublic))
+			for _, source := range playlistSources {
+				params.Add("source", source)
+			}
+			result, err := postPlaylist(params)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "added %d of %d matching tracks to %s (%s)\n", result.Added, result.Matched, result.Name, result.URI)
+			return nil
+		},
+	}
+)
+
+// Asks the server to write a search to a playlist as the user of the chosen session
+func postPlaylist(params url.Values) (pkg.PlaylistResult, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(playlistServer, "/")+"/api/playlist", strings.NewReader(params.Encode()))
+	if err != nil {
+		return pkg.PlaylistResult{}, fmt.Errorf("could not construct http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "session", Value: playlistSession})
+	// The server gives up on writing the playlist after a minute
+	client := http.Client{Timeout: time.Minute * 2}
+	resp, err := client.Do(req)
+	if err != nil {
+		return pkg.PlaylistResult{}, fmt.Errorf("could not reach the versefind server: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return pkg.PlaylistResult{}, fmt.Errorf("could not read the server's response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var validationErr pkg.ValidationError
+		if json.Unmarshal(respBytes, &validationErr) == nil && validationErr.Message != "" {
+			return pkg.PlaylistResult{}, &validationErr
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return pkg.PlaylistResult{}, fmt.Errorf("session %s does not exist, has expired or must log in again", playlistSession)
+		}
+		return pkg.PlaylistResult{}, fmt.Errorf("the server could not write the playlist: status %d", resp.StatusCode)
+	}
+	var result pkg.PlaylistResult
+	if err := json.Unmarshal(respBytes, &result); err != nil {
+		return pkg.PlaylistResult{}, fmt.Errorf("the server returned a non-JSON playlist result: %w", err)
+	}
+	return result, nil
+}
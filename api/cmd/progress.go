@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/zmb3/spotify"
+	"io"
+	"sync"
+	"versefind/pkg"
+)
+
+// Prints a line for each track of a batch as it is processed, counting those which succeeded and failed. Tracks
+// complete out of order, so progress is reported by completion count
+type trackProgress struct {
+	out   io.Writer
+	total int
+	// Describes a track which succeeded, such as "indexed"
+	verb      string
+	mutex     sync.Mutex
+	succeeded int
+	failed    int
+}
+
+func newTrackProgress(out io.Writer, total int, verb string) *trackProgress {
+	return &trackProgress{out: out, total: total, verb: verb}
+}
+
+// Reports that a track was processed, failing with 'err' if it is set. Safe for concurrent use
+func (p *trackProgress) report(track spotify.FullTrack, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	prefix := fmt.Sprintf("[%d/%d]", p.succeeded+p.failed+1, p.total)
+	name := pkg.TrackDisplayName(track)
+	if err != nil {
+		p.failed++
+		_, _ = fmt.Fprintf(p.out, "%s %s: failed: %s\n", prefix, name, err.Error())
+		return
+	}
+	p.succeeded++
+	_, _ = fmt.Fprintf(p.out, "%s %s: %s\n", prefix, name, p.verb)
+}
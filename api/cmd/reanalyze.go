@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"versefind/pkg"
+)
+
+func init() {
+	rootCmd.AddCommand(reanalyzeCmd)
+}
+
+var reanalyzeCmd = &cobra.Command{
+	Use:   "reanalyze",
+	Short: "Recompute the searchable fields of every indexed track",
+	Long: "Recompute the fields versefind derives from each indexed track's Spotify metadata and lyrics, such as the " +
+		"release year and phonetic lyrics, so that tracks indexed by an older version can be searched in every mode. " +
+		"No lyrics are scraped again.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := context.Background()
+		out := cmd.OutOrStdout()
+		n := 0
+		err := trackStore.ForEachTrack(ctx, func(track pkg.VerseTrack) error {
+			track.DeriveFields()
+			if err := trackStore.PutTrack(ctx, track); err != nil {
+				return err
+			}
+			n++
+			if n%100 == 0 {
+				_, _ = fmt.Fprintf(out, "reanalyzed %d tracks\n", n)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(out, "reanalyzed %d tracks\n", n)
+		return nil
+	},
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"strings"
+	"versefind/pkg"
+)
+
+// The most tracks re-fetched in one run, as Elasticsearch does not page search results any deeper
+const maxRefetchTracks = 10000
+
+func init() {
+	refetchCmd.Flags().StringVar(&refetchQuery, "query", "*", "only re-fetch tracks whose lyrics match this query string")
+	refetchCmd.Flags().StringVar(&refetchProvider, "provider", "", "only re-fetch tracks whose lyrics came from this provider")
+	refetchCmd.Flags().Float64Var(&refetchConfidenceMax, "confidence-max", 1, "only re-fetch tracks whose lyrics matched with at most this confidence")
+	refetchCmd.Flags().StringVar(&refetchFetchedBefore, "fetched-before", "", "only re-fetch tracks whose lyrics were fetched before this date or RFC 3339 time")
+	refetchCmd.Flags().IntVar(&refetchScraperVersionMax, "scraper-version-max", 0, "only re-fetch tracks whose lyrics were found by this scraper version or older")
+	refetchCmd.Flags().StringVar(&refetchStatus, "status", "", fmt.Sprintf("only re-fetch tracks whose last lookup had this outcome (one of %s)", strings.Join(pkg.LyricsStatuses, ", ")))
+	refetchCmd.Flags().BoolVar(&refetchDryRun, "dry-run", false, "list the tracks which would be re-fetched without fetching them")
+	rootCmd.AddCommand(refetchCmd)
+}
+
+var (
+	refetchQuery             string
+	refetchProvider          string
+	refetchConfidenceMax     float64
+	refetchFetchedBefore     string
+	refetchScraperVersionMax int
+	refetchStatus            string
+	refetchDryRun            bool
+
+	refetchCmd = &cobra.Command{
+		Use:   "refetch",
+		Short: "Look up the lyrics of indexed tracks again",
+		Long: fmt.Sprintf("Look up the lyrics of the indexed tracks matching the given provenance filters again and "+
+			"replace them, for example to correct lyrics from a provider which was returning bad data, or found by an "+
+			"older scraper version. Tracks indexed before provenance was recorded have scraper version 0. At most %d "+
+			"tracks are re-fetched per run.", maxRefetchTracks),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if refetchStatus != "" && !pkg.IsLyricsStatus(refetchStatus) {
+				return fmt.Errorf("unknown lyrics status %s", refetchStatus)
+			}
+			var filters pkg.TrackFilters
+			filters.Provider = refetchProvider
+			filters.Status = refetchStatus
+			// Tracks wrongly taken for instrumentals may need re-fetching too
+			filters.IncludeInstrumental = true
+			if cmd.Flags().Changed("confidence-max") {
+				filters.ConfidenceMax = &refetchConfidenceMax
+			}
+			if cmd.Flags().Changed("scraper-version-max") {
+				filters.ScraperVersionMax = &refetchScraperVersionMax
+			}
+			if refetchFetchedBefore != "" {
+				fetchedBefore, err := pkg.ParseTime(refetchFetchedBefore)
+				if err != nil {
+					return err
+				}
+				filters.FetchedBefore = &fetchedBefore
+			}
+
+			ctx := context.Background()
+			out := cmd.OutOrStdout()
+			// All matches are collected before any is re-fetched, as re-fetching changes the provenance on which the
+			// search may filter
+			tracks, total, err := pkg.SearchAllTracks(ctx, pkg.TrackSearch{Query: refetchQuery, Mode: pkg.SearchModeQuery, Filters: filters}, maxRefetchTracks)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(out, "%d tracks match, re-fetching %d\n", total, len(tracks))
+			if refetchDryRun {
+				for _, track := range tracks {
+					_, _ = fmt.Fprintf(out, "%s %s\n", track.ID, pkg.TrackDisplayName(track))
+				}
+				return nil
+			}
+
+			progress := newTrackProgress(out, len(tracks), "re-fetched")
+			pkg.RefetchTracks(ctx, tracks, progress.report)
+			_, _ = fmt.Fprintf(out, "re-fetched %d tracks, %d failed\n", progress.succeeded, progress.failed)
+			return nil
+		},
+	}
+)
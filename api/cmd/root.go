@@ -1,8 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 	"versefind/pkg"
 )
 
@@ -11,6 +17,18 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&listenAddr, "listen", "0.0.0.0:3001", "the address and port on which to listen")
 	rootCmd.PersistentFlags().StringVar(&oauthRedirectAddr, "oauthredirectaddr", "https://versefind.vesey.tech/api/callback", "the oauth redirect endpoint")
 	rootCmd.PersistentFlags().StringVar(&esAddr, "elastic", "http://127.0.0.1:9200", "the Elastic instance in which to cache track data and lyric content")
+	rootCmd.PersistentFlags().StringVar(&storeKind, "store", "elastic", fmt.Sprintf("the track store backend to use (one of %s)", strings.Join(pkg.TrackStoreKinds, ", ")))
+	rootCmd.PersistentFlags().StringVar(&blevePath, "bleve", "versefind.bleve", "the on-disk index path used by the bleve track store")
+	rootCmd.Flags().StringVar(&sessionsPath, "sessions", "versefind-sessions.db", "the database file in which user sessions are persisted")
+	rootCmd.Flags().DurationVar(&sessionTTL, "session-ttl", time.Hour*24*30, "how long an unused session is kept before it expires")
+	rootCmd.Flags().DurationVar(&resyncInterval, "resync-interval", time.Hour*6, "how often every user's library is synced in the background (0 to disable)")
+	rootCmd.PersistentFlags().DurationVar(&recheckInterval, "recheck-interval", time.Hour*24*30, "how often tracks for which no provider had lyrics are looked up again (0 to disable)")
+	rootCmd.PersistentFlags().StringSliceVar(&providerOrder, "providers", pkg.ProviderNames(), "the order in which lyrics providers are consulted")
+	rootCmd.PersistentFlags().StringToStringVar(&providerRates, "provider-rate", map[string]string{"genius": "2", "azlyrics": "0.5", "lrclib": "2"}, "the maximum lookups per second made to each lyrics provider")
+	rootCmd.PersistentFlags().IntVar(&indexConcurrency, "concurrency", 4, "the maximum number of tracks to index concurrently")
+	for _, name := range pkg.ProviderNames() {
+		providerEnabled[name] = rootCmd.PersistentFlags().Bool("provider-"+name, true, fmt.Sprintf("whether to look up lyrics with the %s provider", name))
+	}
 }
 
 var (
@@ -18,24 +36,103 @@ var (
 	listenAddr        string
 	oauthRedirectAddr string
 	esAddr            string
+	storeKind         string
+	blevePath         string
+	sessionsPath      string
+	sessionTTL        time.Duration
+	resyncInterval    time.Duration
+	recheckInterval   time.Duration
+	providerOrder     []string
+	providerEnabled   = map[string]*bool{}
+	providerRates     map[string]string
+	indexConcurrency  int
+	trackStore        pkg.TrackStore
 
 	rootCmd = &cobra.Command{
 		Use:   "versefind",
 		Short: "The backend for the versefind application",
 		Long:  "Versefind is an application to search your Spotify library by lyrical content",
-		RunE: func(cmd *cobra.Command, args []string) error {
+		// Shared setup for the server and every subcommand
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			level, err := log.ParseLevel(verbosity)
 			if err != nil {
 				return err
 			}
 			log.SetLevel(level)
 			log.SetReportCaller(true)
-			pkg.Serve(listenAddr, oauthRedirectAddr, esAddr)
+			// Writing playlists goes through a running server, which holds the track store open
+			if cmd == playlistCmd {
+				return nil
+			}
+			enabled := map[string]bool{}
+			for name, isEnabled := range providerEnabled {
+				enabled[name] = *isEnabled
+			}
+			if err := pkg.UseProviders(providerOrder, enabled); err != nil {
+				return err
+			}
+			rates := map[string]float64{}
+			for name, rate := range providerRates {
+				rates[name], err = strconv.ParseFloat(rate, 64)
+				if err != nil {
+					return fmt.Errorf("invalid rate limit for %s: %w", name, err)
+				}
+			}
+			if err := pkg.SetProviderRateLimits(rates); err != nil {
+				return err
+			}
+			if err := pkg.SetIndexConcurrency(indexConcurrency); err != nil {
+				return err
+			}
+			pkg.SetNotFoundRecheckInterval(recheckInterval)
+			storeLocation := esAddr
+			if storeKind == "bleve" {
+				storeLocation = blevePath
+			}
+			trackStore, err = pkg.OpenTrackStore(storeKind, storeLocation)
+			if err != nil {
+				return err
+			}
+			// Only the migration may run against an outdated index, as filters on fields it lacks would match nothing
+			if elasticStore, ok := trackStore.(*pkg.ElasticStore); ok && cmd != migrateCmd {
+				if err := elasticStore.CheckIndexVersion(context.Background()); err != nil {
+					_ = trackStore.Close()
+					return err
+				}
+			}
+			pkg.UseTrackStore(trackStore)
 			return nil
 		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sessionStore, err := openSessionStore()
+			if err != nil {
+				return err
+			}
+			defer func() { _ = sessionStore.Close() }()
+			pkg.UseSessionStore(sessionStore)
+			pkg.SetResyncInterval(resyncInterval)
+			pkg.Serve(listenAddr, oauthRedirectAddr)
+			return nil
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			if trackStore == nil {
+				return nil
+			}
+			return trackStore.Close()
+		},
 	}
 )
 
+// Opens the session database, encrypting tokens with SESSION_KEY or, failing that, the Spotify OAuth2 client secret
+func openSessionStore() (*pkg.SessionStore, error) {
+	secret := os.Getenv("SESSION_KEY")
+	if secret == "" {
+		log.Warnf("SESSION_KEY is not set - encrypting sessions with OAUTH_SECRET instead")
+		secret = os.Getenv("OAUTH_SECRET")
+	}
+	return pkg.OpenSessionStore(sessionsPath, secret, sessionTTL)
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalf(err.Error())
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"strings"
+	"versefind/pkg"
+)
+
+func init() {
+	searchCmd.Flags().IntVar(&searchLimit, "limit", 20, "the maximum number of results to return")
+	searchCmd.Flags().IntVar(&searchOffset, "offset", 0, "the number of results to skip")
+	searchCmd.Flags().StringVar(&searchMode, "mode", pkg.SearchModeQuery, fmt.Sprintf("how QUERY is interpreted (one of %s)", strings.Join(pkg.SearchModes, ", ")))
+	searchCmd.Flags().StringSliceVar(&searchFields, "fields", nil, "the fields searched by query terms which do not name a field (default: all fields)")
+	searchCmd.Flags().StringVar(&searchOutput, "output", "text", "the output format, one of text, json or tsv")
+	rootCmd.AddCommand(searchCmd)
+}
+
+var (
+	searchLimit  int
+	searchOffset int
+	searchMode   string
+	searchFields []string
+	searchOutput string
+
+	searchCmd = &cobra.Command{
+		Use:   "search QUERY",
+		Short: "Search the indexed tracks by lyrical content",
+		Long: "Search every indexed track with the same search used by the API, without restricting results to a " +
+			"user's library. In the default query mode QUERY uses Lucene query string syntax; the other modes take " +
+			"plain text.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if searchOutput != "text" && searchOutput != "json" && searchOutput != "tsv" {
+				return fmt.Errorf("unknown output format %s", searchOutput)
+			}
+			if !pkg.IsSearchMode(searchMode) {
+				return fmt.Errorf("unknown search mode %s", searchMode)
+			}
+			results, err := pkg.SearchTracks(context.Background(), pkg.TrackSearch{
+				Query:  strings.Join(args, " "),
+				Mode:   searchMode,
+				Fields: searchFields,
+				Limit:  searchLimit,
+				Offset: searchOffset,
+			})
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			switch searchOutput {
+			case "json":
+				encoder := json.NewEncoder(out)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(results)
+			case "tsv":
+				_, _ = fmt.Fprintln(out, "id\tartists\ttitle\talbum")
+				for _, result := range results.Results {
+					var artistNames []string
+					for _, artist := range result.Spotify.Artists {
+						artistNames = append(artistNames, artist.Name)
+					}
+					_, _ = fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", result.Spotify.ID, strings.Join(artistNames, ", "), result.Spotify.Name, result.Spotify.Album.Name)
+				}
+			default:
+				for idx, result := range results.Results {
+					_, _ = fmt.Fprintf(out, "%d. %s (%s)\n", searchOffset+idx+1, pkg.TrackDisplayName(result.Spotify), result.Spotify.URI)
+					for _, snippet := range result.Snippets {
+						label := fmt.Sprintf("%d", snippet.Line+1)
+						if snippet.Section != "" {
+							label += fmt.Sprintf(" [%s]", snippet.Section)
+						}
+						if snippet.PositionMs != nil {
+							seconds := *snippet.PositionMs / 1000
+							label += fmt.Sprintf(" @%d:%02d", seconds/60, seconds%60)
+						}
+						_, _ = fmt.Fprintf(out, "   %s: %s\n", label, snippet.Text)
+					}
+				}
+				_, _ = fmt.Fprintf(out, "showing %d of %d results\n", len(results.Results), results.Total)
+			}
+			return nil
+		},
+	}
+)
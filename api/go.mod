@@ -4,13 +4,19 @@ go 1.14
 
 require (
 	github.com/PuerkitoBio/goquery v1.7.1
+	github.com/blevesearch/bleve/v2 v2.3.10
 	github.com/elastic/go-elasticsearch/v8 v8.0.0-20210803104406-75ced8d6cd1c
+	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/gorilla/websocket v1.4.2
+	github.com/json-iterator/go v1.1.11 // indirect
+	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/sirupsen/logrus v1.8.1
-	github.com/spf13/cobra v1.2.1
+	github.com/spf13/cobra v1.7.0
 	github.com/zmb3/spotify v1.3.0
-	golang.org/x/net v0.0.0-20210805182204-aaa1db679c0d // indirect
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/oauth2 v0.0.0-20210805134026-6f1e6394065a
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	golang.org/x/sync v0.1.0
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
+	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 )
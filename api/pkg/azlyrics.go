@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Looks up lyrics via the AZLyrics search page and scrapes them from the best matching song page
+type AZLyricsProvider struct{}
+
+func (p *AZLyricsProvider) Name() string {
+	return "azlyrics"
+}
+
+func (p *AZLyricsProvider) Lookup(ctx context.Context, query LyricsQuery) (LyricsResult, bool, error) {
+	// Search for the lyrics
+	searchCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	params := url.Values{}
+	params.Set("q", query.SearchText())
+	u := &url.URL{Scheme: "https", Host: "search.azlyrics.com", Path: "/search.php", RawQuery: params.Encode()}
+	req, err := http.NewRequestWithContext(searchCtx, "GET", u.String(), nil)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not construct http request: %w", err)
+	}
+	req.Header.Set("User-Agent", "")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not perform http request with %s: %w", u.String(), err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not read response body: %w", err)
+	}
+	// Choose the result which best matches the track. Each result row links the quoted song title, followed by the
+	// artist in bold
+	var link string
+	var confidence float64
+	doc.Find("table td").Each(func(_ int, row *goquery.Selection) {
+		anchor := row.Find("a[href]").First()
+		href, exists := anchor.Attr("href")
+		if !exists {
+			return
+		}
+		candidate := LyricsCandidate{Title: strings.Trim(strings.TrimSpace(anchor.Text()), `"`)}
+		if artist := strings.TrimSpace(row.ChildrenFiltered("b").Last().Text()); artist != "" {
+			candidate.Artists = []string{artist}
+		}
+		if score := matchConfidence(query, candidate); score > confidence {
+			link = href
+			confidence = score
+		}
+	})
+	if link == "" || confidence < minMatchConfidence {
+		return LyricsResult{}, false, nil
+	}
+
+	// Scrape the lyrics
+	pageCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	req, err = http.NewRequestWithContext(pageCtx, "GET", link, nil)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not construct http request: %w", err)
+	}
+	req.Header.Set("User-Agent", "")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not perform http request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	doc, err = goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not read response body: %w", err)
+	}
+	lyrics := doc.Find("div.main-page > div.row > div.text-center > div:nth-of-type(5)").First().Text()
+	lyrics = strings.TrimSpace(lyrics)
+	return LyricsResult{Lyrics: lyrics, Provider: p.Name(), URL: link, Confidence: confidence}, true, nil
+}
@@ -0,0 +1,266 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type GeniusSearchResult struct {
+	Meta struct {
+		Status int `json:"status"`
+	} `json:"meta"`
+	Response struct {
+		Sections []struct {
+			Type string `json:"type"`
+			Hits []struct {
+				Highlights []interface{} `json:"highlights"`
+				Index      string        `json:"index"`
+				Type       string        `json:"type"`
+				Result     struct {
+					Type                     string      `json:"_type"`
+					AnnotationCount          int         `json:"annotation_count"`
+					APIPath                  string      `json:"api_path"`
+					FullTitle                string      `json:"full_title"`
+					HeaderImageThumbnailURL  string      `json:"header_image_thumbnail_url"`
+					HeaderImageURL           string      `json:"header_image_url"`
+					ID                       int         `json:"id"`
+					Instrumental             bool        `json:"instrumental"`
+					LyricsOwnerID            int         `json:"lyrics_owner_id"`
+					LyricsState              string      `json:"lyrics_state"`
+					LyricsUpdatedAt          int         `json:"lyrics_updated_at"`
+					Path                     string      `json:"path"`
+					PyongsCount              interface{} `json:"pyongs_count"`
+					SongArtImageThumbnailURL string      `json:"song_art_image_thumbnail_url"`
+					SongArtImageURL          string      `json:"song_art_image_url"`
+					Stats                    struct {
+						UnreviewedAnnotations int  `json:"unreviewed_annotations"`
+						Hot                   bool `json:"hot"`
+					} `json:"stats"`
+					Title             string `json:"title"`
+					TitleWithFeatured string `json:"title_with_featured"`
+					UpdatedByHumanAt  int    `json:"updated_by_human_at"`
+					URL               string `json:"url"`
+					PrimaryArtist     struct {
+						Type           string `json:"_type"`
+						APIPath        string `json:"api_path"`
+						HeaderImageURL string `json:"header_image_url"`
+						ID             int    `json:"id"`
+						ImageURL       string `json:"image_url"`
+						IndexCharacter string `json:"index_character"`
+						IsMemeVerified bool   `json:"is_meme_verified"`
+						IsVerified     bool   `json:"is_verified"`
+						Name           string `json:"name"`
+						Slug           string `json:"slug"`
+						URL            string `json:"url"`
+					} `json:"primary_artist"`
+				} `json:"result"`
+			} `json:"hits"`
+		} `json:"sections"`
+	} `json:"response"`
+}
+
+// Looks up lyrics via the Genius search API and scrapes them from the matching song page
+type GeniusProvider struct {
+	// The address from which Genius is fetched, overridden in tests. Empty for https://genius.com
+	baseURL string
+}
+
+func (p *GeniusProvider) Name() string {
+	return "genius"
+}
+
+// Builds the address of a Genius page or API endpoint
+func (p *GeniusProvider) pageURL(path string, params url.Values) *url.URL {
+	u := &url.URL{Scheme: "https", Host: "genius.com"}
+	if p.baseURL != "" {
+		base, err := url.Parse(p.baseURL)
+		if err != nil {
+			log.Fatalf("invalid genius base URL %s: %s", p.baseURL, err.Error())
+		}
+		u = base
+	}
+	u.Path = path
+	u.RawQuery = params.Encode()
+	return u
+}
+
+func (p *GeniusProvider) Lookup(ctx context.Context, query LyricsQuery) (LyricsResult, bool, error) {
+	searchCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	params := url.Values{}
+	params.Set("q", query.SearchText())
+	u := p.pageURL("/api/search/multi", params)
+	req, err := http.NewRequestWithContext(searchCtx, "GET", u.String(), nil)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not construct http request: %w", err)
+	}
+	req.Header.Set("User-Agent", "")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not perform http request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not read response body: %w", err)
+	}
+	var respJson GeniusSearchResult
+	err = json.Unmarshal(respData, &respJson)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not unmarshal response data: %w", err)
+	}
+	// Choose the song which best matches the track, as the top hit is often a cover, remix or another song entirely
+	var link string
+	var confidence float64
+	var instrumental bool
+	for _, section := range respJson.Response.Sections {
+		for _, hit := range section.Hits {
+			// Ensure this isn't a Genius or Spotify listicle instead of lyrics
+			if hit.Index != "song" || hit.Result.PrimaryArtist.Name == "Genius" || hit.Result.PrimaryArtist.Name == "Spotify" {
+				continue
+			}
+			candidate := LyricsCandidate{Title: hit.Result.Title, Artists: []string{hit.Result.PrimaryArtist.Name}}
+			if score := matchConfidence(query, candidate); score > confidence {
+				link = hit.Result.Path
+				confidence = score
+				instrumental = hit.Result.Instrumental
+			}
+		}
+	}
+	if link == "" || confidence < minMatchConfidence {
+		return LyricsResult{}, false, nil
+	}
+	if instrumental {
+		u = p.pageURL(link, nil)
+		return LyricsResult{Provider: p.Name(), URL: u.String(), Confidence: confidence, Instrumental: true}, true, nil
+	}
+
+	// Scrape the lyrics from the found track page
+	pageCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	u = p.pageURL(link, nil)
+	req, err = http.NewRequestWithContext(pageCtx, "GET", u.String(), nil)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not construct http request: %w", err)
+	}
+	req.Header.Set("User-Agent", "")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not perform http request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return LyricsResult{}, false, fmt.Errorf("could not read response body: %w", err)
+	}
+	lyrics, ok := extractGeniusLyrics(doc)
+	if !ok {
+		// Songs whose lyrics are unreleased or not yet transcribed show a placeholder instead
+		if doc.Find(`[class^="LyricsPlaceholder"]`).Length() > 0 {
+			return LyricsResult{}, false, nil
+		}
+		return LyricsResult{}, false, errors.New("page does not contain lyrics")
+	}
+
+	return LyricsResult{Lyrics: lyrics, Provider: p.Name(), URL: u.String(), Confidence: confidence}, true, nil
+}
+
+// Extracts the lyrics from a Genius song page, as one line of text per line of lyrics with section headers such as
+// [Chorus] on lines of their own. Current pages split the lyrics across several data-lyrics-container elements, broken
+// into lines by <br> elements, while older pages hold them in a single div.lyrics. In both, annotated lines are wrapped
+// in links, which are reduced to their text. Returns false if the page holds no lyrics
+func extractGeniusLyrics(doc *goquery.Document) (string, bool) {
+	containers := doc.Find(`[data-lyrics-container="true"]`)
+	if containers.Length() == 0 {
+		containers = doc.Find("div.lyrics")
+	}
+	extractor := &geniusExtractor{}
+	containers.Each(func(_ int, container *goquery.Selection) {
+		// Containers are split at line boundaries, often around adverts
+		extractor.lineBreak()
+		extractor.extract(container)
+	})
+	lyrics := normalizeGeniusLyrics(extractor.text.String())
+	return lyrics, lyrics != ""
+}
+
+// Accumulates the text of the lyrics elements of a Genius song page
+type geniusExtractor struct {
+	text strings.Builder
+	// Set after a <br>, as older pages also follow each <br> with a newline, which must not count twice
+	afterBreak bool
+}
+
+func (e *geniusExtractor) extract(selection *goquery.Selection) {
+	selection.Contents().Each(func(_ int, node *goquery.Selection) {
+		switch name := goquery.NodeName(node); name {
+		case "#text":
+			text := node.Text()
+			if e.afterBreak {
+				text = strings.TrimPrefix(text, "\n")
+			}
+			if text != "" {
+				e.afterBreak = false
+				e.text.WriteString(text)
+			}
+		case "br":
+			e.text.WriteByte('\n')
+			e.afterBreak = true
+		case "#comment", "script", "style", "button", "svg", "img", "iframe", "noscript":
+		default:
+			// Contributor counts, translation menus and adverts are marked to be left out of copied lyrics
+			if _, excluded := node.Attr("data-exclude-from-selection"); excluded {
+				return
+			}
+			block := name == "p" || name == "div"
+			if block {
+				e.lineBreak()
+			}
+			e.extract(node)
+			if block {
+				e.lineBreak()
+			}
+		}
+	})
+}
+
+// Ends the current line, unless there is none
+func (e *geniusExtractor) lineBreak() {
+	text := e.text.String()
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		e.text.WriteByte('\n')
+		e.afterBreak = true
+	}
+}
+
+// Trims each line of extracted lyrics and collapses runs of blank lines, which separate stanzas, into one. Section
+// headers are always preceded by a blank line, which may be lost where the lyrics are split across containers
+func normalizeGeniusLyrics(text string) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if _, ok := sectionHeader(line); ok && len(lines) > 0 {
+			blank = true
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata with the current output")
+
+// Serves a stand-in for Genius, answering every search with a single song hit whose page is the given HTML fixture
+func newGeniusFixtureServer(t *testing.T, title, artist, fixture string) *httptest.Server {
+	page, err := ioutil.ReadFile(filepath.Join("testdata", "genius", fixture+".html"))
+	if err != nil {
+		t.Fatalf("could not read fixture: %s", err.Error())
+	}
+	search, err := json.Marshal(map[string]interface{}{
+		"meta": map[string]interface{}{"status": 200},
+		"response": map[string]interface{}{
+			"sections": []interface{}{
+				map[string]interface{}{
+					"type": "song",
+					"hits": []interface{}{
+						map[string]interface{}{
+							"index": "song",
+							"type":  "song",
+							"result": map[string]interface{}{
+								"title":          title,
+								"path":           "/" + fixture + "-lyrics",
+								"primary_artist": map[string]interface{}{"name": artist},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not marshal search response: %s", err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/search/multi", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(search)
+	})
+	mux.HandleFunc("/"+fixture+"-lyrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(page)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGeniusLyricsGolden(t *testing.T) {
+	for _, tc := range []struct {
+		fixture string
+		title   string
+		artist  string
+	}{
+		{"modern", "Paper Lanterns", "The Example Band"},
+		{"legacy", "Salt Lines", "The Example Band"},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			server := newGeniusFixtureServer(t, tc.title, tc.artist, tc.fixture)
+			provider := &GeniusProvider{baseURL: server.URL}
+			result, found, err := provider.Lookup(context.Background(), LyricsQuery{Title: tc.title, Artists: []string{tc.artist}})
+			if err != nil {
+				t.Fatalf("lookup failed: %s", err.Error())
+			}
+			if !found {
+				t.Fatal("lookup found no lyrics")
+			}
+			if expected := server.URL + "/" + tc.fixture + "-lyrics"; result.URL != expected {
+				t.Errorf("got URL %s, expected %s", result.URL, expected)
+			}
+
+			golden := filepath.Join("testdata", "genius", tc.fixture+".golden")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, []byte(result.Lyrics+"\n"), 0644); err != nil {
+					t.Fatalf("could not update golden file: %s", err.Error())
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("could not read golden file: %s", err.Error())
+			}
+			if result.Lyrics+"\n" != string(expected) {
+				t.Errorf("extracted lyrics differ from %s:\n%s", golden, result.Lyrics)
+			}
+		})
+	}
+}
+
+func TestGeniusLyricsPlaceholder(t *testing.T) {
+	server := newGeniusFixtureServer(t, "Unreleased Demo", "The Example Band", "placeholder")
+	provider := &GeniusProvider{baseURL: server.URL}
+	_, found, err := provider.Lookup(context.Background(), LyricsQuery{Title: "Unreleased Demo", Artists: []string{"The Example Band"}})
+	if err != nil {
+		t.Fatalf("lookup failed: %s", err.Error())
+	}
+	if found {
+		t.Error("lookup found lyrics on a page without any")
+	}
+}
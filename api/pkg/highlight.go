@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The most snippets returned for a single search hit
+	maxSnippets = 3
+	// The number of lines of context shown either side of a matching line
+	snippetContext = 1
+)
+
+// A matched span of text, as byte offsets with an exclusive end
+type MatchSpan struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// A line of lyrics which matched a search, with its surrounding lines. Match offsets are relative to Text
+type LyricSnippet struct {
+	// The zero-based index of the matching line within the lyrics
+	Line int `json:"line"`
+	// The zero-based index of the stanza containing the line, or -1 if the line is a section header or blank
+	Stanza int `json:"stanza"`
+	// The section of the song containing the line, such as "Chorus", if the lyrics name their sections
+	Section string      `json:"section,omitempty"`
+	Text    string      `json:"text"`
+	Matches []MatchSpan `json:"matches"`
+	Before  []string    `json:"before,omitempty"`
+	After   []string    `json:"after,omitempty"`
+	// The offset of the line into the track in milliseconds, if the lyrics are time-synced
+	PositionMs *int `json:"position_ms,omitempty"`
+	// A Spotify URI which starts playing the track at the line, if the lyrics are time-synced
+	PlaybackURI string `json:"playback_uri,omitempty"`
+}
+
+// Groups matched spans of a track's lyrics, given as offsets into the whole lyrics, into snippets of whole lines with
+// surrounding context and their place in the song, in lyric order
+func buildSnippets(track VerseTrack, spans []MatchSpan) []LyricSnippet {
+	if len(spans) == 0 {
+		return nil
+	}
+	lyrics := track.Lyrics
+	stanzas := track.Stanzas
+	if stanzas == nil {
+		// Tracks indexed before stanzas were stored
+		stanzas = parseStanzas(lyrics)
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+
+	lines := strings.Split(lyrics, "\n")
+	var snippets []LyricSnippet
+	lineStart, lineIdx := 0, 0
+	for _, span := range spans {
+		if span.Start < 0 || span.End > len(lyrics) || span.Start >= span.End {
+			continue
+		}
+		// Advance to the line containing the start of the span
+		for lineIdx < len(lines)-1 && span.Start >= lineStart+len(lines[lineIdx])+1 {
+			lineStart += len(lines[lineIdx]) + 1
+			lineIdx++
+		}
+		end := span.End
+		if end > lineStart+len(lines[lineIdx]) {
+			end = lineStart + len(lines[lineIdx])
+		}
+		match := MatchSpan{Start: span.Start - lineStart, End: end - lineStart}
+
+		if len(snippets) > 0 && snippets[len(snippets)-1].Line == lineIdx {
+			last := &snippets[len(snippets)-1]
+			if last.Matches[len(last.Matches)-1] != match {
+				last.Matches = append(last.Matches, match)
+			}
+			continue
+		}
+		if len(snippets) == maxSnippets {
+			break
+		}
+		snippet := LyricSnippet{Line: lineIdx, Stanza: stanzaOfLine(stanzas, lineIdx), Text: lines[lineIdx], Matches: []MatchSpan{match}}
+		if snippet.Stanza >= 0 {
+			snippet.Section = stanzas[snippet.Stanza].Section
+			if line, ok := stanzaLine(stanzas[snippet.Stanza], lineIdx); ok && line.StartMs != nil {
+				snippet.PositionMs = line.StartMs
+				snippet.PlaybackURI = fmt.Sprintf("%s#%s", track.Spotify.URI, formatTrackPosition(time.Duration(*line.StartMs)*time.Millisecond))
+			}
+		} else if header, ok := sectionHeader(strings.TrimSpace(lines[lineIdx])); ok {
+			snippet.Section = header
+		}
+		for i := lineIdx - snippetContext; i < lineIdx; i++ {
+			if i >= 0 {
+				snippet.Before = append(snippet.Before, lines[i])
+			}
+		}
+		for i := lineIdx + 1; i <= lineIdx+snippetContext && i < len(lines); i++ {
+			snippet.After = append(snippet.After, lines[i])
+		}
+		snippets = append(snippets, snippet)
+	}
+	return snippets
+}
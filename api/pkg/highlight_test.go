@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"github.com/zmb3/spotify"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildSnippets(t *testing.T) {
+	lyrics := "[Verse]\nCafé olé\nnaïve love\n\n[Chorus]\nlove ñ love"
+	track := NewVerseTrack(spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{URI: "spotify:track:versefindtest"}}, LyricsResult{
+		Lyrics:       lyrics,
+		SyncedLyrics: "[00:01.00]Café olé\n[00:02.00]naïve love\n[01:02.00]love ñ love",
+	})
+	// Finds the byte offsets of the nth occurrence of a word in the lyrics
+	find := func(word string, nth int) MatchSpan {
+		start := -1
+		for i := 0; i <= nth; i++ {
+			start += 1 + strings.Index(lyrics[start+1:], word)
+		}
+		return MatchSpan{Start: start, End: start + len(word)}
+	}
+	positionMs := func(ms int) *int { return &ms }
+
+	snippets := buildSnippets(track, []MatchSpan{find("love", 2), find("olé", 0), find("love", 1), find("love", 0), find("love", 2)})
+	expected := []LyricSnippet{
+		{
+			Line: 1, Stanza: 0, Section: "Verse", Text: "Café olé", Matches: []MatchSpan{{Start: 6, End: 10}},
+			Before: []string{"[Verse]"}, After: []string{"naïve love"},
+			PositionMs: positionMs(1000), PlaybackURI: "spotify:track:versefindtest#0:01",
+		},
+		{
+			Line: 2, Stanza: 0, Section: "Verse", Text: "naïve love", Matches: []MatchSpan{{Start: 7, End: 11}},
+			Before: []string{"Café olé"}, After: []string{""},
+			PositionMs: positionMs(2000), PlaybackURI: "spotify:track:versefindtest#0:02",
+		},
+		{
+			Line: 5, Stanza: 1, Section: "Chorus", Text: "love ñ love", Matches: []MatchSpan{{Start: 0, End: 4}, {Start: 8, End: 12}},
+			Before:     []string{"[Chorus]"},
+			PositionMs: positionMs(62000), PlaybackURI: "spotify:track:versefindtest#1:02",
+		},
+	}
+	if !reflect.DeepEqual(snippets, expected) {
+		t.Errorf("buildSnippets gave %+v, expected %+v", snippets, expected)
+	}
+}
+
+func TestBuildSnippetsSpans(t *testing.T) {
+	track := NewVerseTrack(spotify.FullTrack{}, LyricsResult{Lyrics: "één\ntwo\nthree\nfour"})
+	for _, tc := range []struct {
+		name     string
+		spans    []MatchSpan
+		expected map[int][]MatchSpan
+	}{
+		{"span across lines is cut at the line end", []MatchSpan{{Start: 2, End: 9}}, map[int][]MatchSpan{0: {{Start: 2, End: 5}}}},
+		{"invalid spans are ignored", []MatchSpan{{Start: -1, End: 2}, {Start: 4, End: 4}, {Start: 20, End: 30}}, map[int][]MatchSpan{}},
+		{
+			"at most three snippets",
+			[]MatchSpan{{Start: 0, End: 5}, {Start: 6, End: 9}, {Start: 10, End: 15}, {Start: 16, End: 20}},
+			map[int][]MatchSpan{0: {{Start: 0, End: 5}}, 1: {{Start: 0, End: 3}}, 2: {{Start: 0, End: 5}}},
+		},
+	} {
+		matches := map[int][]MatchSpan{}
+		for _, snippet := range buildSnippets(track, tc.spans) {
+			matches[snippet.Line] = snippet.Matches
+		}
+		if !reflect.DeepEqual(matches, tc.expected) {
+			t.Errorf("%s: matched %v, expected %v", tc.name, matches, tc.expected)
+		}
+	}
+}
+
+func TestElasticHighlightSpans(t *testing.T) {
+	for _, tc := range []struct {
+		highlighted string
+		expected    []string
+	}{
+		{"no matches", nil},
+		{"\x01love\x02 will tear us \x01apart\x02", []string{"love", "apart"}},
+		{"naïve \x01café\x02 ñ \x01olé\x02", []string{"café", "olé"}},
+		{"unterminated \x01match", nil},
+	} {
+		text := strings.NewReplacer(highlightPreTag, "", highlightPostTag, "").Replace(tc.highlighted)
+		var matched []string
+		for _, span := range elasticHighlightSpans(tc.highlighted) {
+			matched = append(matched, text[span.Start:span.End])
+		}
+		if !reflect.DeepEqual(matched, tc.expected) {
+			t.Errorf("elasticHighlightSpans(%q) matched %q, expected %q", tc.highlighted, matched, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/zmb3/spotify"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+	"sync"
+)
+
+var (
+	// Deduplicates concurrent indexing of the same track, keyed on Spotify ID
+	indexGroup singleflight.Group
+	// Bounds the number of tracks being indexed at once across all users
+	indexSlots = make(chan struct{}, 4)
+	// Limits the request rate to each lyrics provider, keyed on provider name
+	providerLimiters = map[string]*rate.Limiter{}
+)
+
+// Sets the maximum number of tracks indexed concurrently across all users
+func SetIndexConcurrency(concurrency int) error {
+	if concurrency < 1 {
+		return fmt.Errorf("index concurrency must be at least 1, not %d", concurrency)
+	}
+	indexSlots = make(chan struct{}, concurrency)
+	return nil
+}
+
+// Limits each named lyrics provider to the given number of lookups per second. Providers without a limit are
+// unrestricted
+func SetProviderRateLimits(limits map[string]float64) error {
+	limiters := map[string]*rate.Limiter{}
+	for name, perSecond := range limits {
+		found := false
+		for _, providerName := range ProviderNames() {
+			found = found || providerName == name
+		}
+		if !found {
+			return fmt.Errorf("unknown lyrics provider %s", name)
+		}
+		if perSecond <= 0 {
+			return fmt.Errorf("rate limit for %s must be positive", name)
+		}
+		limiters[name] = rate.NewLimiter(rate.Limit(perSecond), 1)
+	}
+	providerLimiters = limiters
+	return nil
+}
+
+// Indexes the lyrics of a track, sharing the work with any concurrent request to index the same track
+func IndexLyrics(ctx context.Context, track spotify.FullTrack) error {
+	return shareIndexing(ctx, track, false, 0)
+}
+
+// Looks up the lyrics of an already indexed track again and replaces the indexed track, for example to correct
+// lyrics found by an older version of a provider. Shares the work with any concurrent request to re-fetch the same
+// track
+func RefetchLyrics(ctx context.Context, track spotify.FullTrack) error {
+	return shareIndexing(ctx, track, true, 0)
+}
+
+func shareIndexing(ctx context.Context, track spotify.FullTrack, refetch bool, instrumentalness float64) error {
+	key := track.ID.String()
+	if refetch {
+		// Re-fetches must not be absorbed by an index of the same track, which would find it already indexed
+		key = "refetch/" + key
+	}
+	result := indexGroup.DoChan(key, func() (interface{}, error) {
+		// Deliberately detached from 'ctx' so that one caller giving up does not fail the others sharing this work
+		return nil, indexLyrics(context.Background(), track, refetch, instrumentalness)
+	})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case res := <-result:
+		return res.Err
+	}
+}
+
+// Indexes the lyrics of many tracks using the shared, bounded worker pool. Tracks with a rating in 'instrumentals', as
+// returned by DetectInstrumentals, are stored as instrumental without their lyrics being looked up. 'done' is called,
+// possibly concurrently, as each track completes. Tracks not yet started when 'ctx' is cancelled are skipped.
+func IndexTracks(ctx context.Context, tracks []spotify.FullTrack, instrumentals InstrumentalRatings, done func(track spotify.FullTrack, err error)) {
+	index := func(ctx context.Context, track spotify.FullTrack) error {
+		return shareIndexing(ctx, track, false, instrumentals[track.ID.String()])
+	}
+	runIndexWorkers(ctx, tracks, index, done)
+}
+
+// Re-fetches the lyrics of many indexed tracks using the shared, bounded worker pool, in the manner of IndexTracks
+func RefetchTracks(ctx context.Context, tracks []spotify.FullTrack, done func(track spotify.FullTrack, err error)) {
+	runIndexWorkers(ctx, tracks, RefetchLyrics, done)
+}
+
+func runIndexWorkers(ctx context.Context, tracks []spotify.FullTrack, index func(ctx context.Context, track spotify.FullTrack) error, done func(track spotify.FullTrack, err error)) {
+	queue := make(chan spotify.FullTrack)
+	workers := sync.WaitGroup{}
+	for i := 0; i < cap(indexSlots); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for track := range queue {
+				select {
+				case indexSlots <- struct{}{}:
+				case <-ctx.Done():
+					continue
+				}
+				err := index(ctx, track)
+				<-indexSlots
+				done(track, err)
+			}
+		}()
+	}
+
+Queue:
+	for _, track := range tracks {
+		select {
+		case queue <- track:
+		case <-ctx.Done():
+			break Queue
+		}
+	}
+	close(queue)
+	workers.Wait()
+}
@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+)
+
+// Spotify rates tracks above this instrumentalness as very likely to have no vocals. The threshold is kept high, as
+// tracks wrongly taken for instrumentals are never searchable by their lyrics
+const instrumentalnessThreshold = 0.8
+
+// The most tracks whose audio features can be fetched in one Spotify API request
+const audioFeaturesBatchSize = 100
+
+// The instrumentalness of the tracks which Spotify's audio features rate as instrumental, keyed on Spotify ID
+type InstrumentalRatings map[string]float64
+
+// Fetches the Spotify audio features of tracks about to be indexed, returning the ratings of those which are
+// instrumental, so that they can be passed to IndexTracks and marked as such without their lyrics being looked up.
+// Tracks whose audio features cannot be fetched are looked up as usual
+func DetectInstrumentals(client spotify.Client, tracks []spotify.FullTrack) InstrumentalRatings {
+	ratings := InstrumentalRatings{}
+	for start := 0; start < len(tracks); start += audioFeaturesBatchSize {
+		end := start + audioFeaturesBatchSize
+		if end > len(tracks) {
+			end = len(tracks)
+		}
+		var ids []spotify.ID
+		for _, track := range tracks[start:end] {
+			ids = append(ids, track.ID)
+		}
+		features, err := client.GetAudioFeatures(ids...)
+		if err != nil {
+			log.Warnf("could not fetch audio features: %s", err.Error())
+			return ratings
+		}
+		for _, feature := range features {
+			// Tracks without audio features are returned as null
+			if feature != nil && feature.Instrumentalness > instrumentalnessThreshold {
+				ratings[feature.ID.String()] = float64(feature.Instrumentalness)
+			}
+		}
+	}
+	log.Debugf("spotify rates %d of %d tracks as instrumental", len(ratings), len(tracks))
+	return ratings
+}
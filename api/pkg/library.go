@@ -0,0 +1,345 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+	"strings"
+	"time"
+)
+
+// The parts of a user's Spotify library which can be indexed
+var LibrarySources = []string{"saved", "playlists", "albums", "top", "recent"}
+
+// The library sources indexed when the user does not choose any
+var DefaultLibrarySources = []string{"saved"}
+
+// Where in a user's library a track was found. Type is one of saved, playlist, album, top or recent; playlists and
+// albums are further identified by their Spotify ID and name
+type TrackSource struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// A compact identifier for the source, as used when filtering searches, such as "saved" or "playlist:<id>"
+func (s TrackSource) Key() string {
+	if s.ID == "" {
+		return s.Type
+	}
+	return s.Type + ":" + s.ID
+}
+
+// The library source in which tracks of this source's type are found, as named in LibrarySources
+func (s TrackSource) LibrarySource() string {
+	switch s.Type {
+	case "playlist":
+		return "playlists"
+	case "album":
+		return "albums"
+	default:
+		return s.Type
+	}
+}
+
+// Where a user's last library sync got to, so that the next sync only fetches what has changed. Persisted with the
+// user's session
+type SyncState struct {
+	// The library sources last chosen by the user, which are also used by background syncs
+	Sources []string `json:"sources,omitempty"`
+	// When the most recently saved of the user's saved tracks was added
+	SavedAddedAt time.Time `json:"saved_added_at"`
+	// The number of the user's saved tracks at the last sync
+	SavedTotal int `json:"saved_total"`
+	// When every source was last fetched in full, rather than incrementally
+	FullSyncedAt time.Time `json:"full_synced_at"`
+}
+
+// The tracks gathered from a user's library, in the order first found, with every source each was found in
+type libraryTracks struct {
+	tracks  []spotify.FullTrack
+	sources map[string][]TrackSource
+	// The library sources which were fetched successfully, mapped to whether they were fetched in full. Tracks from a
+	// source fetched incrementally may be missing because they were already seen, rather than because they were removed
+	fetched map[string]bool
+	// The position reached in the user's saved tracks, for the next sync to continue from
+	savedAddedAt time.Time
+	savedTotal   int
+}
+
+func (l *libraryTracks) add(track spotify.FullTrack, source TrackSource) {
+	// Local files and podcast episodes have no track ID and cannot be indexed
+	if track.ID == "" {
+		return
+	}
+	id := track.ID.String()
+	existing, ok := l.sources[id]
+	if !ok {
+		l.tracks = append(l.tracks, track)
+	}
+	for _, s := range existing {
+		if s == source {
+			return
+		}
+	}
+	l.sources[id] = append(existing, source)
+}
+
+// Validates a list of library source names, returning the defaults if none are given
+func ParseLibrarySources(names []string) ([]string, error) {
+	var sources []string
+	for _, name := range names {
+		for _, source := range strings.Split(name, ",") {
+			source = strings.TrimSpace(source)
+			if source == "" {
+				continue
+			}
+			valid := false
+			for _, known := range LibrarySources {
+				valid = valid || known == source
+			}
+			if !valid {
+				return nil, fmt.Errorf("unknown library source %s", source)
+			}
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 0 {
+		return DefaultLibrarySources, nil
+	}
+	return sources, nil
+}
+
+// Fetches the tracks from the chosen sources of a user's library. Saved tracks added since 'since' was recorded are
+// fetched incrementally, unless 'since' is nil or tracks have been removed. Collection stops early if 'halt' returns
+// true. 'progress' is called as tracks are fetched. A source which cannot be fetched (for example because the session
+// predates its scope being requested) is skipped with a warning.
+func collectLibrary(client spotify.Client, sources []string, since *SyncState, halt func() bool, progress func(text string, n, total int)) *libraryTracks {
+	library := &libraryTracks{sources: map[string][]TrackSource{}, fetched: map[string]bool{}}
+	for _, source := range sources {
+		if halt() {
+			break
+		}
+		var err error
+		full := true
+		switch source {
+		case "saved":
+			full, err = collectSavedTracks(client, library, since, halt, progress)
+		case "playlists":
+			full, err = collectPlaylists(client, library, halt, progress)
+		case "albums":
+			err = collectAlbums(client, library, halt, progress)
+		case "top":
+			err = collectTopTracks(client, library, progress)
+		case "recent":
+			err = collectRecentTracks(client, library, progress)
+		}
+		if err != nil {
+			log.Errorf("could not fetch user's %s tracks: %s", source, err.Error())
+			continue
+		}
+		library.fetched[source] = full
+	}
+	return library
+}
+
+// Fetches the user's saved tracks, newest first. If 'since' is given, fetching stops at the first track it has already
+// seen, unless the number of saved tracks shows that some have been removed, in which case every track is fetched.
+// Reports whether every track was fetched
+func collectSavedTracks(client spotify.Client, library *libraryTracks, since *SyncState, halt func() bool, progress func(text string, n, total int)) (bool, error) {
+	userTracks, err := client.CurrentUsersTracks()
+	if err != nil {
+		return false, err
+	}
+	if since != nil {
+		library.savedAddedAt = since.SavedAddedAt
+	}
+	added := 0
+	for !halt() {
+		for pageIdx, userTrack := range userTracks.Tracks {
+			addedAt, err := time.Parse(spotify.TimestampLayout, userTrack.AddedAt)
+			// Without a time the track cannot be placed relative to the last sync, so it is fetched without the position
+			// reached being moved on
+			parsed := err == nil
+			if !parsed {
+				log.Warnf("could not parse time %s at which track %s was saved", userTrack.AddedAt, userTrack.ID)
+			}
+			if parsed && since != nil && !addedAt.After(since.SavedAddedAt) {
+				// Every track from here on was seen by the last sync. If the number of saved tracks has grown by exactly
+				// those added since, none have been removed
+				library.savedTotal = userTracks.Total
+				if since.SavedTotal+added == userTracks.Total {
+					return false, nil
+				}
+				log.Debugf("saved tracks have been removed since the last sync - fetching them all")
+				since = nil
+			}
+			if parsed && addedAt.After(library.savedAddedAt) {
+				library.savedAddedAt = addedAt
+			}
+			added++
+			library.add(userTrack.FullTrack, TrackSource{Type: "saved"})
+			progress("Indexing Spotify", userTracks.Offset+pageIdx+1, userTracks.Total)
+		}
+		err = client.NextPage(userTracks)
+		if errors.Is(err, spotify.ErrNoMorePages) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	library.savedTotal = userTracks.Total
+	return true, nil
+}
+
+// Fetches the tracks of every playlist the user has. A playlist whose tracks cannot be fetched is skipped with a
+// warning. Reports whether the tracks of every playlist were fetched, as those of a skipped playlist are not known to
+// have been removed
+func collectPlaylists(client spotify.Client, library *libraryTracks, halt func() bool, progress func(text string, n, total int)) (bool, error) {
+	// The current user's playlists include both those they own and those they follow
+	var playlists []spotify.SimplePlaylist
+	playlistPage, err := client.CurrentUsersPlaylists()
+	if err != nil {
+		return false, err
+	}
+	for {
+		playlists = append(playlists, playlistPage.Playlists...)
+		err = client.NextPage(playlistPage)
+		if errors.Is(err, spotify.ErrNoMorePages) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	full := true
+	for playlistIdx, playlist := range playlists {
+		if halt() {
+			return false, nil
+		}
+		source := TrackSource{Type: "playlist", ID: playlist.ID.String(), Name: playlist.Name}
+		trackPage, err := client.GetPlaylistTracks(playlist.ID)
+		if err != nil {
+			log.Warnf("could not fetch tracks of playlist %s: %s", playlist.ID, err.Error())
+			full = false
+			continue
+		}
+		for !halt() {
+			for _, playlistTrack := range trackPage.Tracks {
+				if !playlistTrack.IsLocal {
+					library.add(playlistTrack.Track, source)
+				}
+			}
+			err = client.NextPage(trackPage)
+			if errors.Is(err, spotify.ErrNoMorePages) {
+				break
+			}
+			if err != nil {
+				log.Warnf("could not fetch tracks of playlist %s: %s", playlist.ID, err.Error())
+				full = false
+				break
+			}
+		}
+		progress("Indexing Spotify playlists", playlistIdx+1, len(playlists))
+	}
+	return full && !halt(), nil
+}
+
+func collectAlbums(client spotify.Client, library *libraryTracks, halt func() bool, progress func(text string, n, total int)) error {
+	albumPage, err := client.CurrentUsersAlbums()
+	if err != nil {
+		return err
+	}
+	for !halt() {
+		for pageIdx, album := range albumPage.Albums {
+			source := TrackSource{Type: "album", ID: album.ID.String(), Name: album.Name}
+			var trackIDs []spotify.ID
+			trackPage := album.Tracks
+			for {
+				for _, track := range trackPage.Tracks {
+					trackIDs = append(trackIDs, track.ID)
+				}
+				err = client.NextPage(&trackPage)
+				if errors.Is(err, spotify.ErrNoMorePages) {
+					break
+				}
+				if err != nil {
+					return err
+				}
+			}
+			tracks, err := getFullTracks(client, trackIDs)
+			if err != nil {
+				return err
+			}
+			for _, track := range tracks {
+				library.add(track, source)
+			}
+			progress("Indexing Spotify albums", albumPage.Offset+pageIdx+1, albumPage.Total)
+		}
+		err = client.NextPage(albumPage)
+		if errors.Is(err, spotify.ErrNoMorePages) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func collectTopTracks(client spotify.Client, library *libraryTracks, progress func(text string, n, total int)) error {
+	limit := 50
+	topTracks, err := client.CurrentUsersTopTracksOpt(&spotify.Options{Limit: &limit})
+	if err != nil {
+		return err
+	}
+	for idx, track := range topTracks.Tracks {
+		library.add(track, TrackSource{Type: "top"})
+		progress("Indexing Spotify top tracks", idx+1, len(topTracks.Tracks))
+	}
+	return nil
+}
+
+func collectRecentTracks(client spotify.Client, library *libraryTracks, progress func(text string, n, total int)) error {
+	recent, err := client.PlayerRecentlyPlayedOpt(&spotify.RecentlyPlayedOptions{Limit: 50})
+	if err != nil {
+		return err
+	}
+	var trackIDs []spotify.ID
+	for _, item := range recent {
+		trackIDs = append(trackIDs, item.Track.ID)
+	}
+	tracks, err := getFullTracks(client, trackIDs)
+	if err != nil {
+		return err
+	}
+	for idx, track := range tracks {
+		library.add(track, TrackSource{Type: "recent"})
+		progress("Indexing recently played", idx+1, len(tracks))
+	}
+	return nil
+}
+
+// Fetches the full track objects for the given IDs, in batches as allowed by the Spotify API
+func getFullTracks(client spotify.Client, ids []spotify.ID) ([]spotify.FullTrack, error) {
+	var tracks []spotify.FullTrack
+	for start := 0; start < len(ids); start += 50 {
+		end := start + 50
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch, err := client.GetTracks(ids[start:end]...)
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range batch {
+			if track != nil {
+				tracks = append(tracks, *track)
+			}
+		}
+	}
+	return tracks, nil
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A line of time-synced lyrics, starting at the given offset into the track
+type syncedLine struct {
+	Start time.Duration
+	Text  string
+}
+
+// Parses lyrics in the LRC format, in which each line is prefixed with one or more [mm:ss.xx] timestamps. A line with
+// several timestamps is repeated at each of them. An [offset:+/-ms] tag brings every line forward by the given number
+// of milliseconds, or back if it is negative. Other lines without a timestamp, such as [ar:Artist] metadata tags, are
+// dropped. The lines are returned in time order
+func parseLRC(lrc string) []syncedLine {
+	var lines []syncedLine
+	var offset time.Duration
+	for _, line := range strings.Split(lrc, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[offset:") && strings.HasSuffix(line, "]") {
+			if ms, err := strconv.Atoi(strings.TrimSpace(line[len("[offset:") : len(line)-1])); err == nil {
+				offset = time.Duration(ms) * time.Millisecond
+			}
+			continue
+		}
+		var starts []time.Duration
+		for strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 {
+				break
+			}
+			start, ok := parseLRCTimestamp(line[1:end])
+			if !ok {
+				break
+			}
+			starts = append(starts, start)
+			line = line[end+1:]
+		}
+		// Enhanced LRC marks the start of each word with <mm:ss.xx>, which is not kept
+		text := strings.TrimSpace(stripWordTimestamps(line))
+		for _, start := range starts {
+			lines = append(lines, syncedLine{Start: start, Text: text})
+		}
+	}
+	for idx := range lines {
+		if lines[idx].Start -= offset; lines[idx].Start < 0 {
+			lines[idx].Start = 0
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Start < lines[j].Start })
+	return lines
+}
+
+// Parses an LRC timestamp such as 01:23.45, 01:23.456 or 01:23 into an offset from the start of the track
+func parseLRCTimestamp(timestamp string) (time.Duration, bool) {
+	colon := strings.Index(timestamp, ":")
+	if colon < 1 {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(timestamp[:colon])
+	if err != nil || minutes < 0 {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(timestamp[colon+1:], 64)
+	if err != nil || seconds < 0 || seconds >= 60 {
+		return 0, false
+	}
+	return time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)).Round(time.Millisecond), true
+}
+
+func stripWordTimestamps(text string) string {
+	var stripped strings.Builder
+	for {
+		start := strings.Index(text, "<")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start:], ">")
+		if end < 0 {
+			break
+		}
+		if _, ok := parseLRCTimestamp(text[start+1 : start+end]); !ok {
+			stripped.WriteString(text[:start+end+1])
+		} else {
+			stripped.WriteString(text[:start])
+		}
+		text = text[start+end+1:]
+	}
+	stripped.WriteString(text)
+	return stripped.String()
+}
+
+// Joins the text of synced lines into plain lyrics, one line per synced line
+func syncedLyricsText(lines []syncedLine) string {
+	texts := make([]string, len(lines))
+	for idx, line := range lines {
+		texts[idx] = line.Text
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Formats an offset into a track as m:ss, as used in Spotify links to a moment in a track
+func formatTrackPosition(position time.Duration) string {
+	seconds := int(position / time.Second)
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// Sets the start time of each line of stanzas from the synced line with the same text. The lines are matched in order,
+// so a repeated line takes the time of its next occurrence, and lines of the plain lyrics missing from the synced
+// lyrics are left without a time
+func timeStanzas(stanzas []LyricStanza, lines []syncedLine) {
+	next := 0
+	for stanzaIdx := range stanzas {
+		for lineIdx := range stanzas[stanzaIdx].Lines {
+			line := &stanzas[stanzaIdx].Lines[lineIdx]
+			text := normalizeName(line.Text)
+			for syncedIdx := next; syncedIdx < len(lines); syncedIdx++ {
+				if normalizeName(lines[syncedIdx].Text) == text {
+					startMs := int(lines[syncedIdx].Start / time.Millisecond)
+					line.StartMs = &startMs
+					next = syncedIdx + 1
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLRC(t *testing.T) {
+	ms := time.Millisecond
+	for _, tc := range []struct {
+		name     string
+		lrc      string
+		expected []syncedLine
+	}{
+		{
+			"lines in order",
+			"[00:01.00]one\n[00:02.50]two",
+			[]syncedLine{{1000 * ms, "one"}, {2500 * ms, "two"}},
+		},
+		{
+			"timestamp precision",
+			"[00:01]one\n[00:02.5]two\n[01:03.456]three",
+			[]syncedLine{{1000 * ms, "one"}, {2500 * ms, "two"}, {63456 * ms, "three"}},
+		},
+		{
+			"multiple timestamps per line",
+			"[00:01.00][00:05.00]chorus\n[00:03.00]verse",
+			[]syncedLine{{1000 * ms, "chorus"}, {3000 * ms, "verse"}, {5000 * ms, "chorus"}},
+		},
+		{
+			"metadata tags",
+			"[ar:Artist]\n[ti:Title]\n[length:03:00]\n[00:01.00]one",
+			[]syncedLine{{1000 * ms, "one"}},
+		},
+		{
+			"positive offset",
+			"[offset:+500]\n[00:01.00]one\n[00:00.20]zero",
+			[]syncedLine{{0, "zero"}, {500 * ms, "one"}},
+		},
+		{
+			"negative offset",
+			"[00:01.00]one\n[offset:-250]",
+			[]syncedLine{{1250 * ms, "one"}},
+		},
+		{
+			"unparseable offset",
+			"[offset:soon]\n[00:01.00]one",
+			[]syncedLine{{1000 * ms, "one"}},
+		},
+		{
+			"bad tags",
+			"[00:61.00]too many seconds\n[-1:00.00]negative\n[aa:bb]letters\n[00:01.00\nunterminated\n[00:02.00][bad]kept",
+			[]syncedLine{{2000 * ms, "[bad]kept"}},
+		},
+		{
+			"word timestamps",
+			"[00:01.00]<00:01.00>one <00:01.50>two <not a time>",
+			[]syncedLine{{1000 * ms, "one two <not a time>"}},
+		},
+		{
+			"blank lines kept",
+			"[00:01.00]one\n[00:02.00]\n\n[00:03.00] two ",
+			[]syncedLine{{1000 * ms, "one"}, {2000 * ms, ""}, {3000 * ms, "two"}},
+		},
+		{"empty", "", nil},
+	} {
+		if lines := parseLRC(tc.lrc); !reflect.DeepEqual(lines, tc.expected) {
+			t.Errorf("%s: parseLRC(%q) = %v, expected %v", tc.name, tc.lrc, lines, tc.expected)
+		}
+	}
+}
+
+func TestTimeStanzas(t *testing.T) {
+	stanzas := parseStanzas("[Verse]\nHello, world\nnot synced\n\n[Chorus]\nla la\nHello world")
+	timeStanzas(stanzas, parseLRC("[00:01.00]hello world\n[00:02.00]la la\n[00:03.00]hello world"))
+	var starts []interface{}
+	for _, stanza := range stanzas {
+		for _, line := range stanza.Lines {
+			if line.StartMs == nil {
+				starts = append(starts, nil)
+			} else {
+				starts = append(starts, *line.StartMs)
+			}
+		}
+	}
+	if expected := []interface{}{1000, nil, 2000, 3000}; !reflect.DeepEqual(starts, expected) {
+		t.Errorf("lines timed at %v, expected %v", starts, expected)
+	}
+}
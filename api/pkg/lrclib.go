@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A track's lyrics as returned by the LRCLIB API
+type LRCLibTrack struct {
+	ID           int     `json:"id"`
+	TrackName    string  `json:"trackName"`
+	ArtistName   string  `json:"artistName"`
+	AlbumName    string  `json:"albumName"`
+	Duration     float64 `json:"duration"`
+	Instrumental bool    `json:"instrumental"`
+	PlainLyrics  string  `json:"plainLyrics"`
+	SyncedLyrics string  `json:"syncedLyrics"`
+}
+
+// Looks up lyrics, time-synced where available, via the LRCLIB API. It is consulted after the other providers by
+// default, and can be moved ahead of them with the providers flag to prefer time-synced lyrics
+type LRCLibProvider struct{}
+
+func (p *LRCLibProvider) Name() string {
+	return "lrclib"
+}
+
+func (p *LRCLibProvider) Lookup(ctx context.Context, query LyricsQuery) (LyricsResult, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	// LRCLIB credits a track's artists in many ways, so only the primary artist can be relied upon to match exactly
+	artist := ""
+	if len(query.Artists) > 0 {
+		artist = query.Artists[0]
+	}
+	params := url.Values{}
+	params.Set("track_name", query.Title)
+	params.Set("artist_name", artist)
+	params.Set("album_name", query.Album)
+	params.Set("duration", strconv.Itoa(int(query.Duration.Round(time.Second)/time.Second)))
+	var track LRCLibTrack
+	found, err := p.get(ctx, "/api/get", params, &track)
+	if err != nil {
+		return LyricsResult{}, false, err
+	}
+	if found {
+		if result, ok := p.result(query, track); ok {
+			return result, true, nil
+		}
+	}
+
+	// Without an exact match, take the best of the tracks LRCLIB finds for the title and artist
+	params = url.Values{}
+	params.Set("track_name", query.Title)
+	params.Set("artist_name", artist)
+	var tracks []LRCLibTrack
+	if _, err := p.get(ctx, "/api/search", params, &tracks); err != nil {
+		return LyricsResult{}, false, err
+	}
+	var best LyricsResult
+	found = false
+	for _, track := range tracks {
+		if result, ok := p.result(query, track); ok && (!found || result.Confidence > best.Confidence) {
+			best = result
+			found = true
+		}
+	}
+	return best, found, nil
+}
+
+// Makes a request to the LRCLIB API, decoding the response into 'into'. Reports false if LRCLIB has no such resource
+func (p *LRCLibProvider) get(ctx context.Context, path string, params url.Values, into interface{}) (bool, error) {
+	u := &url.URL{Scheme: "https", Host: "lrclib.net", Path: path, RawQuery: params.Encode()}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return false, fmt.Errorf("could not construct http request: %w", err)
+	}
+	// LRCLIB asks that clients identify themselves
+	req.Header.Set("User-Agent", "versefind")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("could not perform http request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == 404 {
+		return false, nil
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("lrclib returned status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+		return false, fmt.Errorf("could not unmarshal response data: %w", err)
+	}
+	return true, nil
+}
+
+// Builds the result for a track returned by LRCLIB, reporting false if it has no lyrics or does not match the query
+func (p *LRCLibProvider) result(query LyricsQuery, track LRCLibTrack) (LyricsResult, bool) {
+	lyrics := strings.TrimSpace(track.PlainLyrics)
+	synced := strings.TrimSpace(track.SyncedLyrics)
+	if lyrics == "" && synced == "" && !track.Instrumental {
+		return LyricsResult{}, false
+	}
+	// LRCLIB falls back to fuzzy matching when no exact match exists, so check what it returned
+	candidate := LyricsCandidate{
+		Title:    track.TrackName,
+		Artists:  []string{track.ArtistName},
+		Duration: time.Duration(track.Duration * float64(time.Second)),
+	}
+	confidence := matchConfidence(query, candidate)
+	if confidence < minMatchConfidence {
+		return LyricsResult{}, false
+	}
+	page := &url.URL{Scheme: "https", Host: "lrclib.net", Path: fmt.Sprintf("/api/get/%d", track.ID)}
+	if track.Instrumental {
+		return LyricsResult{Provider: p.Name(), URL: page.String(), Confidence: confidence, Instrumental: true}, true
+	}
+	return LyricsResult{Lyrics: lyrics, SyncedLyrics: synced, Provider: p.Name(), URL: page.String(), Confidence: confidence}, true
+}
@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"github.com/blevesearch/bleve/v2/analysis/char/asciifolding"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Lyrics matched with less confidence than this are rejected as belonging to a different song
+	minMatchConfidence = 0.5
+	// Lyrics matched with less confidence than this are flagged, and only used if no provider has a better match
+	flagMatchConfidence = 0.75
+	// Durations within this of each other are treated as the same recording
+	durationTolerance = time.Second * 5
+	// Songs whose artists are less similar than this are by someone else, however well the title matches
+	minArtistSimilarity = 0.5
+)
+
+var (
+	// Bracketed asides naming a featured artist or a version of a song, such as "(feat. X)" or "[Remastered 2011]"
+	titleAsidePattern = regexp.MustCompile(`(?i)\s*[(\[][^)\]]*\b(feat|ft|featuring|with|remaster(ed)?|live|remix|mix|version|edit|mono|stereo|acoustic|demo|bonus|instrumental|explicit|clean|single|deluxe|re-?recorded|taylor's)\b[^)\]]*[)\]]`)
+	// Dash-separated suffixes naming a version of a song, such as " - Remastered 2011", " - Live at Wembley" or
+	// " - Radio Edit". The suffix must describe a version as a whole, so that "Tonight - Live Forever" is kept
+	titleSuffixPattern = regexp.MustCompile(`(?i)\s+[-–—]\s+(` +
+		`(\d{4}\s+)?(digital(ly)?\s+)?remaster(ed)?(\s+\d{4})?(\s+version)?` +
+		`|(\S+\s+){0,2}(remix|mix|version|edit|session|demo|recording)` +
+		`|mono|stereo|acoustic|instrumental|single|bonus\s+track|live` +
+		`|(live|recorded)\s+(at|in|from|on)\s.*` +
+		`|from\s+(the\s+)?(["“]|motion\s+picture|original|film|soundtrack|musical|series).*` +
+		`)$`)
+	// Unbracketed featured artist credits, such as "Song feat. X"
+	titleFeaturePattern = regexp.MustCompile(`(?i)\s+(feat\.?|ft\.?|featuring)\s+.*$`)
+	// Separators between the names of several credited artists. "x", as in "A x B", is left out as it also ends names
+	// such as "Malcolm X", and a credit left whole still matches its artists as whole words
+	artistSeparatorPattern = regexp.MustCompile(`(?i)\s*(,|&|\band\b|\bfeat\.?|\bft\.?|\bfeaturing\b|\bwith\b)\s*`)
+)
+
+// A song offered by a lyrics provider, to be compared with the track being looked up
+type LyricsCandidate struct {
+	Title   string
+	Artists []string
+	// The length of the song, if the provider knows it
+	Duration time.Duration
+}
+
+// Reduces a song title to the words identifying the song, dropping featured artists and version descriptions such as
+// "- Remastered 2011" or "(Live)", along with case, accents and punctuation
+func normalizeTitle(title string) string {
+	stripped := titleAsidePattern.ReplaceAllString(title, "")
+	stripped = titleSuffixPattern.ReplaceAllString(stripped, "")
+	stripped = titleFeaturePattern.ReplaceAllString(stripped, "")
+	if normalizeName(stripped) == "" {
+		// The whole title was a version description, so compare it as written
+		stripped = title
+	}
+	return normalizeName(stripped)
+}
+
+// Lowercases a name and removes accents and punctuation, so that differences in typography do not prevent a match
+func normalizeName(name string) string {
+	var normalized strings.Builder
+	space := false
+	folded := string(asciifolding.New().Filter([]byte(strings.ToLower(name))))
+	for _, r := range folded {
+		switch {
+		case r == '&':
+			if normalized.Len() > 0 && !space {
+				normalized.WriteByte(' ')
+			}
+			normalized.WriteString("and")
+			space = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && normalized.Len() > 0 {
+				normalized.WriteByte(' ')
+			}
+			space = false
+			normalized.WriteRune(r)
+		case r == '\'' || r == '’' || r == '.':
+			// Dropped without splitting words, so that "don't" matches "dont" and "A.M." matches "AM"
+		default:
+			space = true
+		}
+	}
+	return normalized.String()
+}
+
+// Splits an artist credit such as "X & Y feat. Z" into the normalized names of its artists
+func splitArtists(credit string) []string {
+	var artists []string
+	for _, artist := range artistSeparatorPattern.Split(credit, -1) {
+		if artist = normalizeName(artist); artist != "" {
+			artists = append(artists, artist)
+		}
+	}
+	return artists
+}
+
+// Scores how likely a provider's song is to be the track being looked up, from 0 to 1, by comparing titles, artists
+// and, where both are known, durations. The title must match for the score to be high, and a song by a clearly different
+// artist scores 0, as many songs share a title. A partly matching artist only lowers the score
+func matchConfidence(query LyricsQuery, candidate LyricsCandidate) float64 {
+	titleScore := similarity(normalizeTitle(query.Title), normalizeTitle(candidate.Title))
+
+	// The best match between any of the track's artists and any of the candidate's, as providers often credit only the
+	// primary artist, or credit several artists as one
+	var queryArtists, candidateArtists []string
+	for _, artist := range query.Artists {
+		queryArtists = append(queryArtists, splitArtists(artist)...)
+	}
+	for _, artist := range candidate.Artists {
+		candidateArtists = append(candidateArtists, splitArtists(artist)...)
+	}
+	artistScore := 0.0
+	for _, queryArtist := range queryArtists {
+		for _, candidateArtist := range candidateArtists {
+			artistScore = math.Max(artistScore, similarity(queryArtist, candidateArtist))
+		}
+	}
+	if len(queryArtists) == 0 || len(candidateArtists) == 0 {
+		// Nothing to compare, so neither penalise nor reward the match
+		artistScore = 0.5
+	} else if artistScore < minArtistSimilarity {
+		return 0
+	}
+
+	confidence := titleScore * (0.4 + 0.6*artistScore)
+	if query.Duration > 0 && candidate.Duration > 0 {
+		difference := query.Duration - candidate.Duration
+		if difference < 0 {
+			difference = -difference
+		}
+		if difference > durationTolerance {
+			// Halve the confidence for each further half minute of difference, as this is likely another recording
+			confidence *= math.Pow(0.5, (difference-durationTolerance).Seconds()/30)
+		}
+	}
+	return confidence
+}
+
+// Scores the similarity of two normalized strings from 0 to 1, by their edit distance relative to their length. A
+// string containing the other as a whole word sequence scores at least 0.8, as in "song" and "song part 2"
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	if a == "" || b == "" {
+		return 0
+	}
+	ar, br := []rune(a), []rune(b)
+	longest := len(ar)
+	if len(br) > longest {
+		longest = len(br)
+	}
+	score := 1 - float64(levenshtein(ar, br))/float64(longest)
+	if strings.Contains(" "+a+" ", " "+b+" ") || strings.Contains(" "+b+" ", " "+a+" ") {
+		score = math.Max(score, 0.8)
+	}
+	return score
+}
+
+// The number of single character insertions, deletions and substitutions needed to turn one string into another
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	min := values[0]
+	for _, value := range values[1:] {
+		if value < min {
+			min = value
+		}
+	}
+	return min
+}
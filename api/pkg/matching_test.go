@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTitle(t *testing.T) {
+	for _, tc := range []struct {
+		title    string
+		expected string
+	}{
+		{"Hello", "hello"},
+		{"Don’t Stop Me Now", "dont stop me now"},
+		{"Señorita", "senorita"},
+		{"Yesterday - Remastered 2009", "yesterday"},
+		{"Heroes - 2017 Remaster", "heroes"},
+		{"Bohemian Rhapsody - Live at Wembley '86", "bohemian rhapsody"},
+		{"Jump - Live", "jump"},
+		{"Africa - Radio Edit", "africa"},
+		{"All Too Well - Taylor's Version", "all too well"},
+		{"Let It Go - From \"Frozen\"", "let it go"},
+		{"Tonight - Live Forever", "tonight live forever"},
+		{"Bad Guy (feat. Justin Bieber)", "bad guy"},
+		{"Stay [Remastered 2011]", "stay"},
+		{"Old Town Road feat. Billy Ray Cyrus", "old town road"},
+		{"(Acoustic Version)", "acoustic version"},
+	} {
+		if normalized := normalizeTitle(tc.title); normalized != tc.expected {
+			t.Errorf("normalizeTitle(%q) = %q, expected %q", tc.title, normalized, tc.expected)
+		}
+	}
+}
+
+func TestSplitArtists(t *testing.T) {
+	for _, tc := range []struct {
+		credit   string
+		expected []string
+	}{
+		{"Adele", []string{"adele"}},
+		{"Malcolm X", []string{"malcolm x"}},
+		{"Simon & Garfunkel", []string{"simon", "garfunkel"}},
+		{"Calvin Harris, Dua Lipa", []string{"calvin harris", "dua lipa"}},
+		{"Drake feat. Rihanna", []string{"drake", "rihanna"}},
+		{"Sam Smith with Kim Petras", []string{"sam smith", "kim petras"}},
+		{"Beyoncé", []string{"beyonce"}},
+	} {
+		if artists := splitArtists(tc.credit); !reflect.DeepEqual(artists, tc.expected) {
+			t.Errorf("splitArtists(%q) = %q, expected %q", tc.credit, artists, tc.expected)
+		}
+	}
+}
+
+func TestMatchConfidence(t *testing.T) {
+	const (
+		rejected = iota
+		flagged
+		accepted
+	)
+	for _, tc := range []struct {
+		name      string
+		query     LyricsQuery
+		candidate LyricsCandidate
+		expected  int
+	}{
+		{
+			"same song",
+			LyricsQuery{Title: "Hello", Artists: []string{"Adele"}, Duration: time.Second * 295},
+			LyricsCandidate{Title: "Hello", Artists: []string{"Adele"}, Duration: time.Second * 296},
+			accepted,
+		},
+		{
+			"remastered version",
+			LyricsQuery{Title: "Yesterday - Remastered 2009", Artists: []string{"The Beatles"}},
+			LyricsCandidate{Title: "Yesterday", Artists: []string{"The Beatles"}},
+			accepted,
+		},
+		{
+			"featured artist credited together",
+			LyricsQuery{Title: "Bad Guy", Artists: []string{"Billie Eilish", "Justin Bieber"}},
+			LyricsCandidate{Title: "bad guy (feat. Justin Bieber)", Artists: []string{"Billie Eilish & Justin Bieber"}},
+			accepted,
+		},
+		{
+			"different artist with the same title",
+			LyricsQuery{Title: "Hello", Artists: []string{"Adele"}},
+			LyricsCandidate{Title: "Hello", Artists: []string{"Lionel Richie"}},
+			rejected,
+		},
+		{
+			"different title by the same artist",
+			LyricsQuery{Title: "Hello", Artists: []string{"Adele"}},
+			LyricsCandidate{Title: "Skyfall", Artists: []string{"Adele"}},
+			rejected,
+		},
+		{
+			"unknown artist",
+			LyricsQuery{Title: "Hello", Artists: []string{"Adele"}},
+			LyricsCandidate{Title: "Hello"},
+			flagged,
+		},
+		{
+			"artist differently spelt",
+			LyricsQuery{Title: "So What", Artists: []string{"P!nk"}},
+			LyricsCandidate{Title: "So What", Artists: []string{"Pink"}},
+			accepted,
+		},
+		{
+			"another recording",
+			LyricsQuery{Title: "Hello", Artists: []string{"Adele"}, Duration: time.Second * 295},
+			LyricsCandidate{Title: "Hello", Artists: []string{"Adele"}, Duration: time.Second * 355},
+			rejected,
+		},
+	} {
+		confidence := matchConfidence(tc.query, tc.candidate)
+		outcome := accepted
+		switch {
+		case confidence < minMatchConfidence:
+			outcome = rejected
+		case confidence < flagMatchConfidence:
+			outcome = flagged
+		}
+		if outcome != tc.expected {
+			t.Errorf("%s: confidence %.2f gives outcome %d, expected %d", tc.name, confidence, outcome, tc.expected)
+		}
+	}
+}
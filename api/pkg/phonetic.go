@@ -0,0 +1,231 @@
+package pkg
+
+import (
+	"strings"
+	"unicode"
+)
+
+// A word of lyrics and its phonetic code, with the code's offsets in the encoded text and the word's offsets in the
+// original text
+type phoneticToken struct {
+	Code        string
+	Start, End  int
+	SourceStart int
+	SourceEnd   int
+}
+
+// Encodes text as the Metaphone codes of its words, separated by spaces, keeping the line structure of the original.
+// Words without a code are dropped
+func encodePhonetic(text string) (string, []phoneticToken) {
+	var encoded strings.Builder
+	var tokens []phoneticToken
+	lineStart := 0
+	for lineIdx, line := range strings.Split(text, "\n") {
+		if lineIdx > 0 {
+			encoded.WriteByte('\n')
+		}
+		lineHasCode := false
+		wordStart := -1
+		flush := func(end int) {
+			if wordStart < 0 {
+				return
+			}
+			code := metaphone(line[wordStart:end])
+			if code != "" {
+				if lineHasCode {
+					encoded.WriteByte(' ')
+				}
+				lineHasCode = true
+				tokens = append(tokens, phoneticToken{
+					Code:        code,
+					Start:       encoded.Len(),
+					End:         encoded.Len() + len(code),
+					SourceStart: lineStart + wordStart,
+					SourceEnd:   lineStart + end,
+				})
+				encoded.WriteString(code)
+			}
+			wordStart = -1
+		}
+		for idx, r := range line {
+			isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' || r == '’'
+			if isWordRune && wordStart < 0 {
+				wordStart = idx
+			} else if !isWordRune {
+				flush(idx)
+			}
+		}
+		flush(len(line))
+		lineStart += len(line) + 1
+	}
+	return encoded.String(), tokens
+}
+
+// Encodes a search query phonetically, as a single line
+func phoneticQuery(query string) string {
+	encoded, _ := encodePhonetic(strings.ReplaceAll(query, "\n", " "))
+	return encoded
+}
+
+// Maps spans matched in the phonetic encoding of some lyrics back to the words of the lyrics they encode
+func phoneticSpansToLyrics(lyrics string, spans []MatchSpan) []MatchSpan {
+	if len(spans) == 0 {
+		return nil
+	}
+	_, tokens := encodePhonetic(lyrics)
+	var lyricSpans []MatchSpan
+	for _, span := range spans {
+		for _, token := range tokens {
+			if token.Start < span.End && span.Start < token.End {
+				lyricSpans = append(lyricSpans, MatchSpan{Start: token.SourceStart, End: token.SourceEnd})
+			}
+		}
+	}
+	return lyricSpans
+}
+
+// Computes the Metaphone code of a word, a rough encoding of how it sounds in English. "th" is encoded as 0 and "sh"
+// as X. Characters other than unaccented Latin letters are ignored
+func metaphone(word string) string {
+	var letters []byte
+	for _, r := range strings.ToUpper(word) {
+		if r >= 'A' && r <= 'Z' {
+			letters = append(letters, byte(r))
+		}
+	}
+	if len(letters) == 0 {
+		return ""
+	}
+
+	at := func(idx int) byte {
+		if idx < 0 || idx >= len(letters) {
+			return 0
+		}
+		return letters[idx]
+	}
+	isVowel := func(c byte) bool {
+		return c == 'A' || c == 'E' || c == 'I' || c == 'O' || c == 'U'
+	}
+	isFrontVowel := func(c byte) bool {
+		return c == 'E' || c == 'I' || c == 'Y'
+	}
+
+	// Initial letter combinations with a silent or altered first letter
+	prefix := string(letters)
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	switch prefix {
+	case "AE", "GN", "KN", "PN", "WR":
+		letters = letters[1:]
+	case "WH":
+		letters = append([]byte{'W'}, letters[2:]...)
+	}
+	if letters[0] == 'X' {
+		letters[0] = 'S'
+	}
+
+	var code strings.Builder
+	for i := 0; i < len(letters); i++ {
+		c := letters[i]
+		// Doubled letters sound once, except C
+		if c != 'C' && i > 0 && at(i-1) == c {
+			continue
+		}
+		next := at(i + 1)
+		switch c {
+		case 'A', 'E', 'I', 'O', 'U':
+			if i == 0 {
+				code.WriteByte(c)
+			}
+		case 'B':
+			if !(at(i-1) == 'M' && i == len(letters)-1) {
+				code.WriteByte('B')
+			}
+		case 'C':
+			switch {
+			case next == 'I' && at(i+2) == 'A':
+				code.WriteByte('X')
+			case next == 'H':
+				if at(i-1) == 'S' {
+					code.WriteByte('K')
+				} else {
+					code.WriteByte('X')
+				}
+				i++
+			case isFrontVowel(next):
+				if at(i-1) != 'S' {
+					code.WriteByte('S')
+				}
+			default:
+				code.WriteByte('K')
+			}
+		case 'D':
+			if next == 'G' && isFrontVowel(at(i+2)) {
+				code.WriteByte('J')
+				i++
+			} else {
+				code.WriteByte('T')
+			}
+		case 'G':
+			switch {
+			case next == 'H' && i+2 < len(letters) && !isVowel(at(i+2)):
+				// Silent, as in "night"
+			case next == 'N' && (i+2 == len(letters) || (at(i+2) == 'E' && at(i+3) == 'D' && i+4 == len(letters))):
+				// Silent, as in "sign" and "signed"
+			case isFrontVowel(next) && at(i-1) != 'G':
+				code.WriteByte('J')
+			default:
+				code.WriteByte('K')
+			}
+		case 'H':
+			afterVowel := i > 0 && isVowel(at(i-1))
+			afterModifier := i > 0 && strings.IndexByte("CGPST", at(i-1)) >= 0
+			if !afterModifier && !(afterVowel && !isVowel(next)) {
+				code.WriteByte('H')
+			}
+		case 'K':
+			if at(i-1) != 'C' {
+				code.WriteByte('K')
+			}
+		case 'P':
+			if next == 'H' {
+				code.WriteByte('F')
+			} else {
+				code.WriteByte('P')
+			}
+		case 'Q':
+			code.WriteByte('K')
+		case 'S':
+			if next == 'H' || (next == 'I' && (at(i+2) == 'O' || at(i+2) == 'A')) {
+				code.WriteByte('X')
+			} else {
+				code.WriteByte('S')
+			}
+		case 'T':
+			switch {
+			case next == 'I' && (at(i+2) == 'O' || at(i+2) == 'A'):
+				code.WriteByte('X')
+			case next == 'H':
+				code.WriteByte('0')
+			case next == 'C' && at(i+2) == 'H':
+				// Silent, as in "watch"
+			default:
+				code.WriteByte('T')
+			}
+		case 'V':
+			code.WriteByte('F')
+		case 'W', 'Y':
+			if isVowel(next) {
+				code.WriteByte(c)
+			}
+		case 'X':
+			code.WriteString("KS")
+		case 'Z':
+			code.WriteByte('S')
+		default:
+			code.WriteByte(c)
+		}
+	}
+	return code.String()
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetaphone(t *testing.T) {
+	for _, tc := range []struct {
+		word     string
+		expected string
+	}{
+		{"night", "NT"},
+		{"knight", "NT"},
+		{"nite", "NT"},
+		{"sign", "SN"},
+		{"sine", "SN"},
+		{"signed", "SNT"},
+		{"watch", "WX"},
+		{"wash", "WX"},
+		{"thumb", "0M"},
+		{"phone", "FN"},
+		{"fone", "FN"},
+		{"write", "RT"},
+		{"right", "RT"},
+		{"cherry", "XR"},
+		{"school", "SKL"},
+		{"nation", "NXN"},
+		{"xylophone", "SLFN"},
+		{"gnome", "NM"},
+		{"don't", "TNT"},
+		{"DON'T", "TNT"},
+		{"123", ""},
+		{"", ""},
+	} {
+		if code := metaphone(tc.word); code != tc.expected {
+			t.Errorf("metaphone(%q) = %q, expected %q", tc.word, code, tc.expected)
+		}
+	}
+}
+
+func TestEncodePhonetic(t *testing.T) {
+	lyrics := "Señorita, don't\n\ncafé night 99"
+	encoded, tokens := encodePhonetic(lyrics)
+	if expected := "SRT TNT\n\nKF NT"; encoded != expected {
+		t.Errorf("encodePhonetic(%q) = %q, expected %q", lyrics, encoded, expected)
+	}
+	var codes, words []string
+	for _, token := range tokens {
+		codes = append(codes, encoded[token.Start:token.End])
+		words = append(words, lyrics[token.SourceStart:token.SourceEnd])
+	}
+	if expected := []string{"SRT", "TNT", "KF", "NT"}; !reflect.DeepEqual(codes, expected) {
+		t.Errorf("token offsets give codes %q, expected %q", codes, expected)
+	}
+	if expected := []string{"Señorita", "don't", "café", "night"}; !reflect.DeepEqual(words, expected) {
+		t.Errorf("token source offsets give words %q, expected %q", words, expected)
+	}
+}
+
+func TestPhoneticSpansToLyrics(t *testing.T) {
+	// Encoded as "SRT TNT\n\nKF NT"
+	lyrics := "Señorita, don't\n\ncafé night"
+	for _, tc := range []struct {
+		name     string
+		spans    []MatchSpan
+		expected []string
+	}{
+		{"single word", []MatchSpan{{Start: 12, End: 14}}, []string{"night"}},
+		{"multi-byte word", []MatchSpan{{Start: 0, End: 3}}, []string{"Señorita"}},
+		{"across lines", []MatchSpan{{Start: 4, End: 11}}, []string{"don't", "café"}},
+		{"part of a code", []MatchSpan{{Start: 10, End: 11}}, []string{"café"}},
+		{"between codes", []MatchSpan{{Start: 3, End: 4}}, nil},
+		{"none", nil, nil},
+	} {
+		var words []string
+		for _, span := range phoneticSpansToLyrics(lyrics, tc.spans) {
+			words = append(words, lyrics[span.Start:span.End])
+		}
+		if !reflect.DeepEqual(words, tc.expected) {
+			t.Errorf("%s: mapped to %q, expected %q", tc.name, words, tc.expected)
+		}
+	}
+}
@@ -1,154 +1,168 @@
 package pkg
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/PuerkitoBio/goquery"
-	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"github.com/zmb3/spotify"
 	"golang.org/x/oauth2"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	// Prevents duplicate records from being added
-	syncTrackMutex sync.Mutex
 	// Maps session ids to Spotify account information
 	activeUsers sync.Map
 	// Spotify authenticator object
 	spotifyAuth spotify.Authenticator
+	// OAuth2 configuration used to refresh users' Spotify tokens
+	oauthConfig *oauth2.Config
 	// The OAuth2 client ID for Spotify
 	oauthClientID string
 	// The OAuth2 client secret for Spotify
 	oauthSecret string
-	// Global Elasticsearch connection
-	es *elasticsearch.Client
+	// The scheme and host at which the frontend is served, taken from the OAuth2 redirect URL, as a proxy in front of
+	// the API may not pass the Host header on
+	publicOrigin string
+	// Global track storage backend
+	store TrackStore
+	// Durable storage for user sessions
+	sessions *SessionStore
 )
 
-type GeniusSearchResult struct {
-	Meta struct {
-		Status int `json:"status"`
-	} `json:"meta"`
-	Response struct {
-		Sections []struct {
-			Type string `json:"type"`
-			Hits []struct {
-				Highlights []interface{} `json:"highlights"`
-				Index      string        `json:"index"`
-				Type       string        `json:"type"`
-				Result     struct {
-					Type                     string      `json:"_type"`
-					AnnotationCount          int         `json:"annotation_count"`
-					APIPath                  string      `json:"api_path"`
-					FullTitle                string      `json:"full_title"`
-					HeaderImageThumbnailURL  string      `json:"header_image_thumbnail_url"`
-					HeaderImageURL           string      `json:"header_image_url"`
-					ID                       int         `json:"id"`
-					Instrumental             bool        `json:"instrumental"`
-					LyricsOwnerID            int         `json:"lyrics_owner_id"`
-					LyricsState              string      `json:"lyrics_state"`
-					LyricsUpdatedAt          int         `json:"lyrics_updated_at"`
-					Path                     string      `json:"path"`
-					PyongsCount              interface{} `json:"pyongs_count"`
-					SongArtImageThumbnailURL string      `json:"song_art_image_thumbnail_url"`
-					SongArtImageURL          string      `json:"song_art_image_url"`
-					Stats                    struct {
-						UnreviewedAnnotations int  `json:"unreviewed_annotations"`
-						Hot                   bool `json:"hot"`
-					} `json:"stats"`
-					Title             string `json:"title"`
-					TitleWithFeatured string `json:"title_with_featured"`
-					UpdatedByHumanAt  int    `json:"updated_by_human_at"`
-					URL               string `json:"url"`
-					PrimaryArtist     struct {
-						Type           string `json:"_type"`
-						APIPath        string `json:"api_path"`
-						HeaderImageURL string `json:"header_image_url"`
-						ID             int    `json:"id"`
-						ImageURL       string `json:"image_url"`
-						IndexCharacter string `json:"index_character"`
-						IsMemeVerified bool   `json:"is_meme_verified"`
-						IsVerified     bool   `json:"is_verified"`
-						Name           string `json:"name"`
-						Slug           string `json:"slug"`
-						URL            string `json:"url"`
-					} `json:"primary_artist"`
-				} `json:"result"`
-			} `json:"hits"`
-		} `json:"sections"`
-	} `json:"response"`
-}
-
 // A Versefind indexing progress report, for transmission to and display by the frontend
 type UserProgress struct {
 	Text     string `json:"text"`
 	Complete bool   `json:"complete"`
 	Total    int    `json:"total"`
 	N        int    `json:"n"`
+	// Newly indexed tracks matching the user's saved searches since the last report
+	Matches []SavedSearchMatch `json:"matches,omitempty"`
 }
 
 // A Versefind track combining Spotify data and scraped lyrics
 type VerseTrack struct {
 	Spotify spotify.FullTrack `json:"spotify"`
 	Lyrics  string            `json:"lyrics"`
+	// The release year of the track's album, kept separately so that it can be range filtered
+	Year int `json:"year,omitempty"`
+	// The lyrics encoded phonetically, for matching sound-alike queries
+	LyricsPhonetic string `json:"lyrics_phonetic,omitempty"`
+	// The lyrics split into lines and stanzas, kept for display rather than searched
+	Stanzas []LyricStanza `json:"stanzas,omitempty"`
+	// The lyrics in the LRC format, with the time at which each line is sung, if a provider had them
+	SyncedLyrics string `json:"synced_lyrics,omitempty"`
+	// Where the lyrics came from
+	Provenance LyricsProvenance `json:"provenance"`
+	// Set for tracks without vocals, which are left out of searches unless asked for
+	Instrumental bool `json:"instrumental,omitempty"`
+}
+
+// Builds a VerseTrack from a Spotify track and the lyrics found for it now, deriving the searchable metadata. Synced
+// lyrics in the result time the lines of its plain lyrics, and are only searched if it has no plain lyrics. A zero
+// result records that no provider had lyrics, and schedules a re-check, while an instrumental result marks the track as
+// instrumental
+func NewVerseTrack(track spotify.FullTrack, result LyricsResult) VerseTrack {
+	fetchedAt := time.Now().UTC()
+	verseTrack := VerseTrack{
+		Spotify:      track,
+		Lyrics:       result.Lyrics,
+		SyncedLyrics: result.SyncedLyrics,
+		Provenance: LyricsProvenance{
+			Provider:       result.Provider,
+			URL:            result.URL,
+			FetchedAt:      &fetchedAt,
+			Confidence:     result.Confidence,
+			ScraperVersion: scraperVersion,
+		},
+	}
+	switch {
+	case result.Instrumental:
+		verseTrack.Instrumental = true
+		verseTrack.Provenance.recordLookup(LyricsInstrumental, fetchedAt)
+	case result.Lyrics != "" || result.SyncedLyrics != "":
+		verseTrack.Provenance.recordLookup(LyricsFound, fetchedAt)
+	default:
+		verseTrack.Provenance.recordLookup(LyricsNotFound, fetchedAt)
+	}
+	verseTrack.DeriveFields()
+	return verseTrack
+}
+
+// Recomputes the fields derived from the track's Spotify metadata and lyrics
+func (t *VerseTrack) DeriveFields() {
+	// Release dates are given as YYYY, YYYY-MM or YYYY-MM-DD depending on their precision
+	t.Year = 0
+	if len(t.Spotify.Album.ReleaseDate) >= 4 {
+		t.Year, _ = strconv.Atoi(t.Spotify.Album.ReleaseDate[:4])
+	}
+	// The plain lyrics are kept for their section headers and stanza breaks, which synced lyrics lack. Synced lyrics
+	// only stand in for them if a provider had nothing else
+	synced := parseLRC(t.SyncedLyrics)
+	if t.Lyrics == "" && len(synced) > 0 {
+		t.Lyrics = syncedLyricsText(synced)
+	}
+	// Tracks indexed before lookup statuses were recorded take one from their lyrics, and are due for a re-check at
+	// once if they have none
+	if t.Provenance.Status == "" {
+		t.Provenance.Status = LyricsFound
+		if t.Lyrics == "" {
+			dueAt := time.Unix(0, 0).UTC()
+			t.Provenance.Status = LyricsNotFound
+			t.Provenance.RetryAt = &dueAt
+		}
+	}
+	t.LyricsPhonetic, _ = encodePhonetic(t.Lyrics)
+	t.Stanzas = parseStanzas(t.Lyrics)
+	timeStanzas(t.Stanzas, synced)
 }
 
 // A Versefind search result
 type SearchResults struct {
-	Total   int          `json:"total"`
-	Results []VerseTrack `json:"results"`
+	Total   int         `json:"total"`
+	Results []SearchHit `json:"results"`
 }
 
-// A result from an Elasticsearch query
-type ElasticSearchResult struct {
-	Took     int  `json:"took"`
-	TimedOut bool `json:"timed_out"`
-	Shards   struct {
-		Total      int `json:"total"`
-		Successful int `json:"successful"`
-		Skipped    int `json:"skipped"`
-		Failed     int `json:"failed"`
-	} `json:"_shards"`
-	Hits struct {
-		Total struct {
-			Value    int    `json:"value"`
-			Relation string `json:"relation"`
-		} `json:"total"`
-		MaxScore float64 `json:"max_score"`
-		Hits     []struct {
-			Index  string     `json:"_index"`
-			Type   string     `json:"_type"`
-			ID     string     `json:"_id"`
-			Score  float64    `json:"_score"`
-			Source VerseTrack `json:"_source"`
-		} `json:"hits"`
-	} `json:"hits"`
+// A single track matching a search, annotated for the searching user
+type SearchHit struct {
+	VerseTrack
+	// The relevance of the track to the search, as scored by the track store
+	Score float64 `json:"score"`
+	// The lines of the track's lyrics which matched the search
+	Snippets []LyricSnippet `json:"snippets,omitempty"`
+	// Where in the user's library the track was found
+	Sources []TrackSource `json:"sources,omitempty"`
 }
 
 type activeUser struct {
 	progress           *UserProgress
+	progressMutex      sync.Mutex
 	session            string
 	wsMutex            sync.Mutex
 	ws                 *websocket.Conn
+	tokenMutex         sync.Mutex
 	token              *oauth2.Token
+	reauthRequired     bool
 	indexedTracks      sync.Map
-	indexWaiter        *sync.WaitGroup
 	searchableTrackIDs []string
+	syncMutex          sync.Mutex
+	sources            []string
+	syncState          SyncState
+	syncDone           chan struct{}
+	lastSeenMutex      sync.Mutex
+	lastSeen           time.Time
+	savedSearchMutex   sync.Mutex
+	savedSearches      []SavedSearch
+	pendingMatches     []SavedSearchMatch
 }
 
 func NewActiveUser(session string, token *oauth2.Token) *activeUser {
@@ -158,7 +172,24 @@ func NewActiveUser(session string, token *oauth2.Token) *activeUser {
 		token:         token,
 		progress:      &UserProgress{Complete: true},
 		indexedTracks: sync.Map{},
+		lastSeen:      time.Now(),
+		sources:       DefaultLibrarySources,
+	}
+}
+
+// Records that the user has made a request, extending the expiry of their persisted session. The session store is only
+// written to occasionally, as expiry is measured in days. Reports whether the expiry was extended
+func (u *activeUser) Touch() bool {
+	u.lastSeenMutex.Lock()
+	defer u.lastSeenMutex.Unlock()
+	if time.Since(u.lastSeen) < time.Hour {
+		return false
+	}
+	u.lastSeen = time.Now()
+	if err := sessions.TouchSession(u.session); err != nil {
+		log.Warnf("could not persist session activity: %s", err.Error())
 	}
+	return true
 }
 
 func (u *activeUser) UseWebsocket(ws *websocket.Conn) {
@@ -172,15 +203,30 @@ func (u *activeUser) UseWebsocket(ws *websocket.Conn) {
 	u.ws = ws
 }
 
+// Sets the parts of the user's library indexed by subsequent syncs
+func (u *activeUser) UseSources(sources []string) {
+	u.syncMutex.Lock()
+	defer u.syncMutex.Unlock()
+	u.sources = sources
+}
+
 func (u *activeUser) SendProgress() error {
 	log.Tracef("SendProgress")
+	progress := u.GetProgress()
+	progress.Matches = u.takePendingMatches()
 	u.wsMutex.Lock()
 	defer u.wsMutex.Unlock()
-	log.Tracef("sending user progress: %+v", u.progress)
-	return u.ws.WriteJSON(u.progress)
+	log.Tracef("sending user progress: %+v", progress)
+	err := u.ws.WriteJSON(progress)
+	if err != nil && len(progress.Matches) > 0 {
+		u.requeueMatches(progress.Matches)
+	}
+	return err
 }
 
 func (u *activeUser) SetProgress(n, total int, text string, complete bool) {
+	u.progressMutex.Lock()
+	defer u.progressMutex.Unlock()
 	u.progress.N = n
 	u.progress.Total = total
 	u.progress.Text = text
@@ -188,90 +234,39 @@ func (u *activeUser) SetProgress(n, total int, text string, complete bool) {
 }
 
 func (u *activeUser) GetProgress() UserProgress {
+	u.progressMutex.Lock()
+	defer u.progressMutex.Unlock()
 	return *u.progress
 }
 
+// Syncs the user's library, joining any sync already running, and sends progress reports to the frontend until it
+// completes
 func (u *activeUser) Index() {
-	if u.indexWaiter != nil {
-		u.indexWaiter.Wait()
-		_ = u.SendProgress()
-		return
-	}
-
-	u.indexWaiter = &sync.WaitGroup{}
-	u.indexWaiter.Add(2)
-	haltIndexing := false
-	// Indexer worker. Fetches the user's Spotify tracks and then indexes them in Versefind.
-	go func() {
-		defer u.indexWaiter.Done()
-		defer func() { haltIndexing = true }()
-
-		// Fetch tracks from Spotify
-		client := spotifyAuth.NewClient(u.token)
-		log.Debugf("starting lyric collector")
-		var spotifyTracks []spotify.FullTrack
-		userTracks, err := client.CurrentUsersTracks()
-		if err != nil {
-			log.Errorf("could not fetch user's tracks: %s", err.Error())
-			return
-		}
-		for {
-			if haltIndexing {
-				return
-			}
-			for pageIdx, userTrack := range userTracks.Tracks {
-				spotifyTracks = append(spotifyTracks, userTrack.FullTrack)
-				u.SetProgress(userTracks.Offset+pageIdx+1, userTracks.Total, "Indexing Spotify", false)
-			}
-			if errors.Is(err, spotify.ErrNoMorePages) {
-				break
-			}
-			err = client.NextPage(userTracks)
+	var halted int32
+	done := u.StartSync(func() bool { return atomic.LoadInt32(&halted) == 1 })
+
+	// Send the user's progress to the frontend periodically. If the frontend goes away, a sync started for it is halted
+Progress:
+	for {
+		select {
+		case <-done:
+			break Progress
+		case <-time.After(time.Millisecond * 250):
 		}
-
-		// Remove user's already indexed tracks (if coming from an existing session)
-		for idx := len(spotifyTracks) - 1; idx >= 0; idx-- {
-			if _, ok := u.indexedTracks.Load(spotifyTracks[0].ID.String()); ok {
-				spotifyTracks = append(spotifyTracks[:idx], spotifyTracks[idx+1:]...)
-				idx--
-			}
-		}
-
-		// Index lyrics
-		for trackIdx, track := range spotifyTracks {
-			if haltIndexing {
-				return
-			}
-			err = IndexLyrics(track)
-			if err != nil {
-				log.Warnf("could not index lyrics for %s: %s", track.ID, err.Error())
-				continue
-			}
-			u.indexedTracks.Store(track.ID.String(), track)
-			u.SetProgress(trackIdx+1, len(spotifyTracks), "Indexing lyrics", false)
-		}
-	}()
-
-	// Progress worker. Sends a user's progress to the frontend periodically
-	go func() {
-		defer u.indexWaiter.Done()
-		defer func() { haltIndexing = true }()
-
-		for {
-			err := u.SendProgress()
-			if err != nil {
-				log.Debugf("could not send progress: %s", err.Error())
-				return
-			}
-			if haltIndexing {
-				return
-			}
-			time.Sleep(time.Millisecond * 250)
+		if err := u.SendProgress(); err != nil {
+			log.Debugf("could not send progress: %s", err.Error())
+			atomic.StoreInt32(&halted, 1)
+			return
 		}
-	}()
-	u.indexWaiter.Wait()
+	}
 	log.Tracef("indexing complete")
-	u.SetProgress(0, 0, "", true)
+	if u.ReauthRequired() {
+		// The user's token could not be refreshed, so signal the frontend to log in again
+		u.wsMutex.Lock()
+		_ = u.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, ""))
+		u.wsMutex.Unlock()
+		return
+	}
 	_ = u.SendProgress()
 	// Wait for the frontend to confirm receipt of the last progress report (or close the connection)
 	_, _, _ = u.ws.ReadMessage()
@@ -288,12 +283,39 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	state := hex.EncodeToString(stateBytes)
-	http.SetCookie(w, &http.Cookie{Name: "session", Value: state, Path: "/"})
+	http.SetCookie(w, newSessionCookie(state))
 	authUrl := spotifyAuth.AuthURL(state)
 	log.Debugf("redirecting to auth url %s", authUrl)
 	http.Redirect(w, r, authUrl, 302)
 }
 
+// Builds the cookie identifying a user's session, lasting as long as the session does. It is withheld from requests
+// started by other sites, other than top-level navigations such as the return from Spotify's login page
+func newSessionCookie(session string) *http.Cookie {
+	return &http.Cookie{
+		Name:     "session",
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(sessions.ttl.Seconds()),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Reports whether a request which changes state was made by Versefind's frontend or a client outside a browser, rather
+// than by another site. Browsers always send an Origin header with such requests, while other clients such as the
+// playlist command send none
+func fromSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if origin == publicOrigin {
+		return true
+	}
+	originURL, err := url.Parse(origin)
+	return err == nil && originURL.Host != "" && originURL.Host == r.Host
+}
+
 // OAuth2 callback
 func callbackHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("handling auth callback for %s", r.RemoteAddr)
@@ -313,6 +335,12 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "", 500)
 		return
 	}
+	err = sessions.SaveSession(session, token)
+	if err != nil {
+		log.Errorf("could not persist session: %s", err.Error())
+		http.Error(w, "", 500)
+		return
+	}
 	activeUsers.Store(session, NewActiveUser(session, token))
 	http.Redirect(w, r, "/", 302)
 }
@@ -323,51 +351,62 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	upgrader := &websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
 		return true
 	}}
-	ws, err := upgrader.Upgrade(w, r, nil)
+	// The user is looked up before upgrading, so that a reissued session cookie can be sent with the upgrade response
+	header := http.Header{}
+	user, userErr := getUserBySession(r, header)
+	ws, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Errorf("could not upgrade websocket: %s", err.Error())
 		return
 	}
 
 	// Ensure the user is authenticated
-	user, err := getUserBySession(r)
-	if err != nil {
-		log.Errorf("could not get user: %s", err.Error())
+	if userErr != nil {
+		log.Errorf("could not get user: %s", userErr.Error())
 		_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "")) // If the user's session is not authenticated with Spotify, return a private use errror code via websocket to signal a reauth is needed
 		return
 	}
+	sources, err := ParseLibrarySources(r.URL.Query()["sources"])
+	if err != nil {
+		log.Infof("invalid library sources: %s", err.Error())
+		_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, err.Error()))
+		return
+	}
 	user.UseWebsocket(ws)
+	// Without a choice of sources, the user's previous choice stands
+	if len(r.URL.Query()["sources"]) > 0 {
+		user.UseSources(sources)
+	}
 	user.Index()
 	log.Tracef("closing websocket")
 }
 
 func searchHandler(w http.ResponseWriter, r *http.Request) {
 	// Attempt to retrieve a spotify API instance by this request's session cookie
-	user, err := getUserBySession(r)
+	user, err := getUserBySession(r, w.Header())
 	if err != nil {
 		log.Errorf("could not get spotify client: %s", err.Error())
 		http.Error(w, "", 403)
 		return
 	}
-	queryString := r.URL.Query().Get("q")
-	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
-	if err != nil {
-		http.Error(w, "", 400)
+	search, err := parseSearchParams(r.URL.Query())
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		writeJSONError(w, 400, validationErr)
 		return
 	}
-	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
-	if err != nil {
-		http.Error(w, "", 400)
+	include, err := parseSearchIncludes(r.URL.Query())
+	if errors.As(err, &validationErr) {
+		writeJSONError(w, 400, validationErr)
 		return
 	}
 
-	log.Tracef("%s performing search with limit=%d, offset=%d for '%s'", r.RemoteAddr, limit, offset, queryString)
+	sourceFilter := r.URL.Query()["source"]
 
-	var userTrackIds []string
-	user.indexedTracks.Range(func(key, value interface{}) bool {
-		userTrackIds = append(userTrackIds, key.(string))
-		return true
-	})
+	log.Tracef("%s performing search with limit=%d, offset=%d, sources=%v, filters=%+v for '%s'", r.RemoteAddr, search.Limit, search.Offset, sourceFilter, search.Filters, search.Query)
+
+	// Restrict the search to the user's tracks, optionally only those found in particular sources
+	userTrackIds := user.IndexedTrackIDs(sourceFilter)
 
 	// Short circuit if there are 0 tracks in the user's current indexed cache
 	if len(userTrackIds) == 0 {
@@ -380,76 +419,59 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	queryJson := map[string]interface{}{
-		"query": map[string]interface{}{
-			"bool": map[string]interface{}{
-				"must": []interface{}{
-					map[string]interface{}{
-						"ids": map[string]interface{}{
-							"values": userTrackIds,
-						},
-					},
-					map[string]interface{}{
-						"query_string": map[string]interface{}{
-							"query":            queryString,
-							"analyze_wildcard": true,
-							"default_operator": "AND",
-						},
-					},
-				},
-			},
-		},
-	}
-	query, err := json.Marshal(queryJson)
-	if err != nil {
-		log.Fatalf("could not marshal query: %s", err.Error())
-	}
-	log.Debugf("raw query: %s", query)
-
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
-	req := esapi.SearchRequest{
-		Index:       []string{"tracks"},
-		Body:        bytes.NewReader(query),
-		TrackScores: &[]bool{true}[0],
-		Size:        &limit,
-		From:        &offset,
-		Explain:     &[]bool{true}[0],
-	}
-	resp, err := req.Do(ctx, es)
-	if err != nil {
-		log.Fatalf("could not search elasticsearch: %s", err.Error())
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+	defer cancel()
+	search.TrackIDs = userTrackIds
+	results, err := SearchTracks(ctx, search)
+	if errors.Is(err, ErrInvalidQuery) {
+		log.Infof("could not search tracks: %s", err.Error())
+		writeJSONError(w, 400, &ValidationError{Field: "q", Message: "could not be parsed"})
+		return
 	}
-	defer func() { _ = resp.Body.Close() }()
-	respBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalf("could read elasticsearch response: %s", err.Error())
-	}
-	if resp.IsError() && resp.StatusCode != 404 {
-		log.Infof("could not search elasticsearch: status %d (%s)", resp.StatusCode, string(respBytes))
-		http.Error(w, "", 400)
+		log.Errorf("could not search tracks: %s", err.Error())
+		http.Error(w, "", 500)
 		return
 	}
-	var respJson ElasticSearchResult
-	err = json.Unmarshal(respBytes, &respJson)
-	if err != nil {
-		log.Fatalf("elastic returned a non-JSON search result")
+	for idx := range results.Results {
+		trackSources, _ := user.indexedTracks.Load(results.Results[idx].Spotify.ID.String())
+		results.Results[idx].Sources, _ = trackSources.([]TrackSource)
+		results.Results[idx].trimForResponse(include)
 	}
-	log.Debugf("search for '%s' returned %d results", queryString, respJson.Hits.Total.Value)
-
-	var trimmedResp SearchResults
-	trimmedResp.Total = respJson.Hits.Total.Value
-	for _, hit := range respJson.Hits.Hits {
-		trimmedResp.Results = append(trimmedResp.Results, hit.Source)
-	}
-	respBytes, err = json.Marshal(trimmedResp)
+	respBytes, err := json.Marshal(results)
 	if err != nil {
 		log.Fatalf("could not marshal trimmed response: %s", err.Error())
 	}
 	_, _ = w.Write(respBytes)
 }
 
-// Uses the session cookie in an HTTP request to retrieve an active Spotify API instance using 'activeUsers'
-func getUserBySession(r *http.Request) (*activeUser, error) {
+// Returns the IDs of the user's indexed tracks, restricted to those found in any of the given sources if there are any
+func (u *activeUser) IndexedTrackIDs(sourceFilter []string) []string {
+	var trackIDs []string
+	u.indexedTracks.Range(func(key, value interface{}) bool {
+		if len(sourceFilter) == 0 || hasAnySource(value.([]TrackSource), sourceFilter) {
+			trackIDs = append(trackIDs, key.(string))
+		}
+		return true
+	})
+	return trackIDs
+}
+
+// Reports whether any of a track's sources has one of the given keys
+func hasAnySource(trackSources []TrackSource, keys []string) bool {
+	for _, source := range trackSources {
+		for _, key := range keys {
+			if source.Key() == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Uses the session cookie in an HTTP request to retrieve an active Spotify API instance using 'activeUsers'. When the
+// session's expiry is extended, the cookie is reissued to last as long, by adding it to the response 'header'
+func getUserBySession(r *http.Request, header http.Header) (*activeUser, error) {
 	sessionCookie, err := r.Cookie("session")
 	if err != nil {
 		return nil, fmt.Errorf("could not get session cookie: %w", err)
@@ -458,257 +480,236 @@ func getUserBySession(r *http.Request) (*activeUser, error) {
 	if !ok {
 		return nil, errors.New("session cookie did not exist")
 	}
-	return ret.(*activeUser), nil
-}
-
-// Check whether this track is already indexed in Elastic
-//noinspection GoNilness
-func elasticTrackExists(spotifyId string) bool {
-	queryObj := map[string]interface{}{
-		"query": map[string]interface{}{
-			"ids": map[string]interface{}{
-				"values": []string{spotifyId},
-			},
-		},
-	}
-
-	query, err := json.Marshal(queryObj)
-	if err != nil {
-		log.Fatalf("could not marshal elastic query to check existing track: %s", err.Error())
-	}
-	req := esapi.SearchRequest{
-		Index: []string{"tracks"},
-		Body:  bytes.NewReader(query),
+	user := ret.(*activeUser)
+	if user.Touch() {
+		header.Add("Set-Cookie", newSessionCookie(user.session).String())
 	}
+	return user, nil
+}
 
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
-	respObj, err := req.Do(ctx, es)
-	if err != nil {
-		log.Warnf("could not query elastic for existing track: %s", err.Error())
-	}
-	defer func() { _ = respObj.Body.Close() }()
-	respBytes, err := ioutil.ReadAll(respObj.Body)
+// Recreates the active users persisted in the session store
+func restoreSessions() error {
+	stored, err := sessions.LoadSessions()
 	if err != nil {
-		log.Fatalf("could not read response from elasticsearch: %s", err.Error())
+		return err
 	}
-	if respObj.IsError() && respObj.StatusCode != 404 {
-		log.Fatalf("could not search elasticsearch: status %d (%s)", respObj.StatusCode, string(respBytes))
+	for _, session := range stored {
+		activeUsers.Store(session.Session, newStoredUser(session))
 	}
-
-	var respJson ElasticSearchResult
-	err = json.Unmarshal(respBytes, &respJson)
-	if err != nil {
-		log.Fatalf("elastic returned a non-JSON search result")
-	}
-	return respJson.Hits.Total.Value > 0
+	log.Infof("restored %d sessions", len(stored))
+	return nil
 }
 
-// Given a track, scrape Genius/AZLyrics if any are present, then index the object in Elasticsearch
-//noinspection GoNilness
-func IndexLyrics(track spotify.FullTrack) error {
-	syncTrackMutex.Lock()
-	defer syncTrackMutex.Unlock()
-	// Check whether the track is already in Elastic
-	if elasticTrackExists(track.ID.String()) {
-		return nil
+// Recreates an active user from their persisted session
+func newStoredUser(session *StoredSession) *activeUser {
+	user := NewActiveUser(session.Session, session.Token)
+	user.lastSeen = session.LastSeen
+	for trackID, trackSources := range session.IndexedTracks {
+		user.indexedTracks.Store(trackID, trackSources)
 	}
-
-	// Prepare the search string with which to query the scrapers
-	var artistNames []string
-	for _, artist := range track.Artists {
-		artistNames = append(artistNames, artist.Name)
+	user.savedSearches = session.SavedSearches
+	user.syncState = session.Sync
+	if len(session.Sync.Sources) > 0 {
+		user.sources = session.Sync.Sources
 	}
-	query := track.Name + " " + strings.Join(artistNames, " ")
-	log.Debugf("%s using query: %s", track.ID, query)
+	return user
+}
 
-	// Search for this track in Genius and AZLyrics
-	lyrics, exists, err := ScrapeGenius(query)
-	if err != nil {
-		return fmt.Errorf("could not scrape lyrics from genius: %w", err)
-	}
-	if !exists {
-		log.Warnf("no genius lyrics were found for %s - trying azlyrics", track.ID)
-		lyrics, exists, err = ScrapeAZLyrics(query)
+// Periodically removes expired sessions from the session store and from memory
+func expireSessions() {
+	for {
+		expired, err := sessions.DeleteExpired()
 		if err != nil {
-			return fmt.Errorf("could not scrape lyrics from azlyrics: %w", err)
+			log.Warnf("could not delete expired sessions: %s", err.Error())
 		}
+		for _, session := range expired {
+			activeUsers.Delete(session)
+		}
+		if len(expired) > 0 {
+			log.Infof("expired %d sessions", len(expired))
+		}
+		time.Sleep(time.Hour)
 	}
-	if !exists {
-		log.Warnf("no azlyrics lyrics were found for %s - defaulting to empty", track.ID)
-		lyrics = ""
-	}
-
-	// Marshal and insert into Elasticsearch
-	jsonDoc, err := json.Marshal(VerseTrack{track, lyrics})
-	if err != nil {
-		log.Fatalf("could not marshal doc for elasticsearch: %s", err.Error())
-	}
-	req := esapi.IndexRequest{
-		DocumentID: track.ID.String(),
-		Index:      "tracks",
-		Body:       bytes.NewReader(jsonDoc),
-		Refresh:    "wait_for",
-	}
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
-	resp, err := req.Do(ctx, es)
-	if err != nil {
-		log.Fatalf("could not index document in elasticsearch: %s", err.Error())
-	}
-	if resp.IsError() {
-		log.Fatalf("could not index document in elasticsearch: status %d", resp.StatusCode)
-	}
-
-	return nil
 }
 
-func ScrapeGenius(query string) (string, bool, error) {
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
-	params := url.Values{}
-	params.Set("q", query)
-	u := &url.URL{Scheme: "https", Host: "genius.com", Path: "/api/search/multi", RawQuery: params.Encode()}
-	req, err := http.NewRequestWithContext(context.Background(), "GET", u.String(), nil)
+// Given a track, scrape lyrics from the enabled lyrics providers if any are present, then index the object in the
+// track store. Tracks already in the store are skipped unless 'refetch' is set or their last lookup failed or found
+// nothing and is due to be retried. Failed lookups are stored so that they are retried with backoff, and the lookup
+// error is returned wrapping ErrLookupFailed. A positive 'instrumentalness' is Spotify's rating of a track it takes for
+// an instrumental, which is stored as such without a lookup. Use IndexLyrics, IndexTracks or their re-fetching
+// counterparts rather than calling this directly
+func indexLyrics(ctx context.Context, track spotify.FullTrack, refetch bool, instrumentalness float64) error {
+	// Check whether the track is already in the store
+	previous, err := store.GetTrack(ctx, track.ID.String())
 	if err != nil {
-		return "", false, fmt.Errorf("could not construct http request: %w", err)
+		return fmt.Errorf("could not check for existing track: %w", err)
 	}
-	req.Header.Set("User-Agent", "")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", false, fmt.Errorf("could not perform http request: %w", err)
-	}
-	respData, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", false, fmt.Errorf("could not read response body: %w", err)
+	if previous != nil && !refetch && !previous.lookupDue(time.Now()) {
+		return nil
 	}
-	var respJson GeniusSearchResult
-	err = json.Unmarshal(respData, &respJson)
-	if err != nil {
-		return "", false, fmt.Errorf("could not unmarshal response data: %w", err)
+
+	// Tracks which Spotify rates as instrumental have no lyrics to look up
+	if instrumentalness > 0 {
+		log.Debugf("%s is instrumental (instrumentalness %.2f) - skipping lyrics lookup", track.ID, instrumentalness)
+		err = store.PutTrack(ctx, NewVerseTrack(track, LyricsResult{Provider: "spotify", Confidence: instrumentalness, Instrumental: true}))
+		if err != nil {
+			return fmt.Errorf("could not store track: %w", err)
+		}
+		return nil
 	}
-	var link string
 
-Outer:
-	for _, section := range respJson.Response.Sections {
-		for _, hit := range section.Hits {
-			// Ensure this isn't a Genius or Spotify listicle instead of lyrics
-			if hit.Index != "song" || hit.Result.PrimaryArtist.Name == "Genius" || hit.Result.PrimaryArtist.Name == "Spotify" {
+	// Prepare the track metadata with which to query the lyrics providers
+	query := LyricsQuery{
+		Title:    track.Name,
+		Album:    track.Album.Name,
+		Duration: track.TimeDuration(),
+	}
+	for _, artist := range track.Artists {
+		query.Artists = append(query.Artists, artist.Name)
+	}
+	log.Debugf("%s using query: %s", track.ID, query.SearchText())
+
+	// Consult each enabled lyrics provider in turn until one has lyrics which confidently match this track. Doubtful
+	// matches are only used if no provider has a better one
+	var best LyricsResult
+	var lookupErr error
+	exists := false
+	for _, provider := range activeProviders {
+		if limiter, ok := providerLimiters[provider.Name()]; ok {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		result, found, err := provider.Lookup(ctx, query)
+		if err != nil {
+			log.Warnf("could not look up lyrics for %s with %s: %s", track.ID, provider.Name(), err.Error())
+			lookupErr = fmt.Errorf("could not scrape lyrics from %s: %w", provider.Name(), err)
+			continue
+		}
+		if !found {
+			log.Debugf("no %s lyrics were found for %s", provider.Name(), track.ID)
+			continue
+		}
+		if result.Confidence < minMatchConfidence {
+			log.Debugf("rejected %s lyrics for %s matched with confidence %.2f (%s)", provider.Name(), track.ID, result.Confidence, result.URL)
+			continue
+		}
+		if result.Instrumental {
+			// Only a confident match may stop the track's lyrics being looked for
+			if result.Confidence < flagMatchConfidence {
+				log.Debugf("ignored %s instrumental for %s matched with confidence %.2f (%s)", provider.Name(), track.ID, result.Confidence, result.URL)
 				continue
 			}
-			link = hit.Result.Path
-			break Outer
+			log.Debugf("%s is instrumental according to %s (%s)", track.ID, provider.Name(), result.URL)
+			best = result
+			exists = true
+			break
+		}
+		if result.Confidence < flagMatchConfidence {
+			log.Warnf("%s lyrics for %s matched with low confidence %.2f (%s)", provider.Name(), track.ID, result.Confidence, result.URL)
+			if !exists || result.Confidence > best.Confidence {
+				best = result
+				exists = true
+			}
+			continue
 		}
+		best = result
+		exists = true
+		break
 	}
-	if link == "" {
-		return "", false, nil
+	if exists {
+		log.Debugf("%s using lyrics from %s (%s) with confidence %.2f", track.ID, best.Provider, best.URL, best.Confidence)
 	}
-
-	// Scrape the lyrics from the found track page
-	ctx, _ = context.WithTimeout(context.Background(), time.Second*5)
-	u = &url.URL{Scheme: "https", Host: "genius.com", Path: link}
-	req, err = http.NewRequestWithContext(ctx, "GET", u.String(), nil)
-	if err != nil {
-		return "", false, fmt.Errorf("could not construct http request: %w", err)
+	if !exists && lookupErr != nil {
+		// Lyrics already indexed are kept rather than lost to a transient error
+		if previous != nil && previous.Lyrics != "" {
+			return fmt.Errorf("%w: %s", ErrLookupFailed, lookupErr.Error())
+		}
+		attempts := 1
+		if previous != nil && previous.Provenance.Status == LyricsFailed {
+			attempts = previous.Provenance.Attempts + 1
+		}
+		failed := NewVerseTrack(track, LyricsResult{})
+		failed.Provenance.recordFailure(attempts, time.Now().UTC())
+		log.Debugf("retrying lyrics lookup for %s at %s (attempt %d)", track.ID, failed.Provenance.RetryAt, attempts)
+		if err := store.PutTrack(ctx, failed); err != nil {
+			return fmt.Errorf("could not store track: %w", err)
+		}
+		return fmt.Errorf("%w: %s", ErrLookupFailed, lookupErr.Error())
 	}
-	req.Header.Set("User-Agent", "")
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		return "", false, fmt.Errorf("could not perform http request: %w", err)
+	if !exists {
+		log.Warnf("no lyrics were found for %s - defaulting to empty", track.ID)
 	}
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+
+	// Insert into the track store
+	err = store.PutTrack(ctx, NewVerseTrack(track, best))
 	if err != nil {
-		return "", false, fmt.Errorf("could not read response body: %w", err)
-	}
-	tag := doc.Find("div.lyrics")
-	lyrics := strings.TrimSpace(tag.Text())
-	if tag.Length() == 0 || lyrics == "" {
-		return "", false, errors.New("page does not contain lyrics")
+		return fmt.Errorf("could not store track: %w", err)
 	}
 
-	return lyrics, true, nil
+	return nil
 }
 
-func ScrapeAZLyrics(query string) (string, bool, error) {
-	// Search for the lyrics
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
-	params := url.Values{}
-	params.Set("q", query)
-	u := &url.URL{Scheme: "https", Host: "search.azlyrics.com", Path: "/search.php", RawQuery: params.Encode()}
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
-	if err != nil {
-		return "", false, fmt.Errorf("could not construct http request: %w", err)
+// Sets up the Spotify OAuth2 flow and token refreshing for users' sessions, with the given redirect URL
+func configureOAuth(oauthRedirectAddr string) error {
+	if err := loadOAuthCredentials(); err != nil {
+		return err
 	}
-	req.Header.Set("User-Agent", "")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", false, fmt.Errorf("could not perform http request with %s: %w", u.String(), err)
+	scopes := []string{
+		spotify.ScopeUserLibraryRead,
+		spotify.ScopePlaylistReadPrivate,
+		spotify.ScopePlaylistReadCollaborative,
+		spotify.ScopePlaylistModifyPublic,
+		spotify.ScopePlaylistModifyPrivate,
+		spotify.ScopeUserTopRead,
+		spotify.ScopeUserReadRecentlyPlayed,
+		spotify.ScopeUserModifyPlaybackState,
 	}
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	redirectURL, err := url.Parse(oauthRedirectAddr)
 	if err != nil {
-		return "", false, fmt.Errorf("could not read response body: %w", err)
-	}
-	link, exists := doc.Find("table a[href]").First().Attr("href")
-	if !exists {
-		return "", false, nil
+		return fmt.Errorf("invalid oauth redirect address: %w", err)
 	}
-
-	// Scrape the lyrics
-	ctx, _ = context.WithTimeout(context.Background(), time.Second*5)
-	req, err = http.NewRequestWithContext(ctx, "GET", link, nil)
-	if err != nil {
-		return "", false, fmt.Errorf("could not construct http request: %w", err)
-	}
-	req.Header.Set("User-Agent", "")
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		return "", false, fmt.Errorf("could not perform http request: %w", err)
-	}
-	doc, err = goquery.NewDocumentFromReader(resp.Body)
-	if err != nil {
-		return "", false, fmt.Errorf("could not read response body: %w", err)
+	publicOrigin = redirectURL.Scheme + "://" + redirectURL.Host
+	spotifyAuth = spotify.NewAuthenticator(oauthRedirectAddr, scopes...)
+	spotifyAuth.SetAuthInfo(oauthClientID, oauthSecret)
+	oauthConfig = &oauth2.Config{
+		ClientID:     oauthClientID,
+		ClientSecret: oauthSecret,
+		RedirectURL:  oauthRedirectAddr,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  spotify.AuthURL,
+			TokenURL: spotify.TokenURL,
+		},
 	}
-	lyrics := doc.Find("div.main-page > div.row > div.text-center > div:nth-of-type(5)").First().Text()
-	lyrics = strings.TrimSpace(lyrics)
-	return lyrics, true, nil
+	return nil
 }
 
-// The main entrypoint to serve a Versefind API instance. Specify a listen address, an oauth redirect URL, and an
-// Elasticsearch instance address
-func Serve(listenAddr, oauthRedirectAddr, esAddr string) {
+// The main entrypoint to serve a Versefind API instance. Specify a listen address and an oauth redirect URL. A track
+// store and a session store must have been configured with UseTrackStore and UseSessionStore beforehand
+func Serve(listenAddr, oauthRedirectAddr string) {
 	activeUsers = sync.Map{}
-	syncTrackMutex = sync.Mutex{}
 	log.SetLevel(log.TraceLevel)
 	log.SetReportCaller(true)
 	log.Infof("versefind api starting")
 
-	oauthClientID = os.Getenv("OAUTH_CLIENTID")
-	oauthSecret = os.Getenv("OAUTH_SECRET")
-
-	if oauthClientID == "" || oauthSecret == "" {
-		log.Fatalf("Spotify OAuth2 credentials are required. Specify with OAUTH_CLIENTID and OAUTH_SECRET.")
+	if err := configureOAuth(oauthRedirectAddr); err != nil {
+		log.Fatalf(err.Error())
 	}
 
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			esAddr,
-		},
-	}
-	var err error
-	es, err = elasticsearch.NewClient(cfg)
-	if err != nil {
-		log.Fatalf("unable to initialize elasticsearch connection: %s", err.Error())
-	}
-	//noinspection GoNilness
-	_, err = es.Ping()
-	if err != nil {
-		log.Fatalf("unable to connect to elasticsearch: %s", err.Error())
+	if err := restoreSessions(); err != nil {
+		log.Fatalf("could not restore sessions: %s", err.Error())
 	}
-	log.Infof("connected to elasticsearch")
-
-	spotifyAuth = spotify.NewAuthenticator(oauthRedirectAddr, spotify.ScopeUserLibraryRead)
-	spotifyAuth.SetAuthInfo(oauthClientID, oauthSecret)
+	go expireSessions()
+	go resyncSessions()
+	go retryLookups()
 
 	http.HandleFunc("/api/auth", authHandler)
 	http.HandleFunc("/api/callback", callbackHandler)
 	http.HandleFunc("/ws", wsHandler)
 	http.HandleFunc("/api/search", searchHandler)
+	http.HandleFunc("/api/play", playHandler)
+	http.HandleFunc("/api/playlist", playlistHandler)
+	http.HandleFunc("/api/searches", savedSearchesHandler)
 	_ = http.ListenAndServe(listenAddr, nil)
 }
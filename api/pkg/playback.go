@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The most tracks which can be played or queued in one request
+const maxPlaybackTracks = 50
+
+// A request to play tracks on one of the user's Spotify devices
+type playbackRequest struct {
+	Tracks []spotify.ID
+	// The offset into the first track at which to start playing
+	PositionMs int
+	// Adds every track to the end of the user's queue rather than starting playback
+	Queue bool
+	// The device to play on. Nil plays on the user's active device
+	DeviceID *spotify.ID
+}
+
+// Parses and validates the parameters of a playback request. Tracks may be given as IDs, URIs or open.spotify.com links,
+// and URIs may carry a #m:ss position, as in a snippet's playback_uri
+func parsePlaybackParams(params url.Values) (playbackRequest, error) {
+	var playback playbackRequest
+	for _, value := range params["track"] {
+		for _, ref := range strings.Split(value, ",") {
+			ref = strings.TrimSpace(ref)
+			if ref == "" {
+				continue
+			}
+			if hash := strings.Index(ref, "#"); hash >= 0 {
+				if len(playback.Tracks) == 0 && params.Get("position_ms") == "" {
+					positionMs, ok := parseTrackPosition(ref[hash+1:])
+					if !ok {
+						return playback, &ValidationError{Field: "track", Message: "position must be given as m:ss"}
+					}
+					playback.PositionMs = positionMs
+				}
+				ref = ref[:hash]
+			}
+			playback.Tracks = append(playback.Tracks, spotify.ID(NormalizeSpotifyID("track", ref)))
+		}
+	}
+	if len(playback.Tracks) == 0 {
+		return playback, &ValidationError{Field: "track", Message: "is required"}
+	}
+	if len(playback.Tracks) > maxPlaybackTracks {
+		return playback, &ValidationError{Field: "track", Message: fmt.Sprintf("must not name more than %d tracks", maxPlaybackTracks)}
+	}
+	positionMs, err := optionalInt(params, "position_ms", 0, 24*60*60*1000)
+	if err != nil {
+		return playback, err
+	}
+	if positionMs != nil {
+		playback.PositionMs = *positionMs
+	}
+	if value := params.Get("queue"); value != "" {
+		playback.Queue, err = strconv.ParseBool(value)
+		if err != nil {
+			return playback, &ValidationError{Field: "queue", Message: "must be true or false"}
+		}
+	}
+	if playback.Queue && playback.PositionMs > 0 {
+		return playback, &ValidationError{Field: "position_ms", Message: "cannot be used when queueing"}
+	}
+	if device := params.Get("device"); device != "" {
+		deviceID := spotify.ID(device)
+		playback.DeviceID = &deviceID
+	}
+	return playback, nil
+}
+
+// Parses a position within a track given as m:ss, returning it in milliseconds
+func parseTrackPosition(position string) (int, bool) {
+	colon := strings.Index(position, ":")
+	if colon < 1 {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(position[:colon])
+	if err != nil || minutes < 0 {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(position[colon+1:])
+	if err != nil || seconds < 0 || seconds >= 60 {
+		return 0, false
+	}
+	return (minutes*60 + seconds) * 1000, true
+}
+
+// Starts playing the requested tracks, or adds them to the queue, on one of the user's devices
+func (u *activeUser) Play(playback playbackRequest) error {
+	client := u.Client()
+	options := &spotify.PlayOptions{DeviceID: playback.DeviceID}
+	if playback.Queue {
+		for _, track := range playback.Tracks {
+			if err := client.QueueSongOpt(track, options); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// The tracks after the first are played in turn once it finishes
+	for _, track := range playback.Tracks {
+		options.URIs = append(options.URIs, spotify.URI("spotify:track:"+track))
+	}
+	options.PositionMs = playback.PositionMs
+	return client.PlayOpt(options)
+}
+
+// Plays search results on the user's active Spotify device, optionally from the matched line, or queues them
+func playHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "", 405)
+		return
+	}
+	if !fromSameOrigin(r) {
+		log.Warnf("rejected %s request to %s from origin %s", r.Method, r.URL.Path, r.Header.Get("Origin"))
+		http.Error(w, "", 403)
+		return
+	}
+	user, err := getUserBySession(r, w.Header())
+	if err != nil {
+		log.Errorf("could not get spotify client: %s", err.Error())
+		http.Error(w, "", 403)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "", 400)
+		return
+	}
+	playback, err := parsePlaybackParams(r.Form)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		writeJSONError(w, 400, validationErr)
+		return
+	}
+
+	log.Tracef("%s playing %d tracks (queue=%t, position=%dms)", r.RemoteAddr, len(playback.Tracks), playback.Queue, playback.PositionMs)
+	err = user.Play(playback)
+	if user.ReauthRequired() {
+		http.Error(w, "", 403)
+		return
+	}
+	var spotifyErr spotify.Error
+	if errors.As(err, &spotifyErr) {
+		log.Infof("spotify refused playback: %s (status %d)", spotifyErr.Message, spotifyErr.Status)
+		switch spotifyErr.Status {
+		case 404:
+			writeJSONError(w, 409, &ValidationError{Field: "device", Message: "no active Spotify device was found"})
+		case 401, 403:
+			// Sessions created before playback control was added lack the scope, as do accounts without Premium
+			writeJSONError(w, 403, &ValidationError{Field: "device", Message: "playback control is not permitted for this account - log in again or check for Spotify Premium"})
+		default:
+			writeJSONError(w, 502, &ValidationError{Field: "track", Message: spotifyErr.Message})
+		}
+		return
+	}
+	if err != nil {
+		log.Errorf("could not start playback: %s", err.Error())
+		http.Error(w, "", 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,223 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// The most tracks a Spotify playlist can hold, and so the most search results written to one
+	maxPlaylistTracks = 10000
+	// The most tracks which can be added to a playlist in one Spotify API request
+	playlistBatchSize = 100
+)
+
+// The playlist into which the tracks matching a search are written. Either PlaylistID names an existing playlist of the
+// user's, or Name is given for a new one
+type PlaylistTarget struct {
+	Name       string
+	PlaylistID string
+	// Removes the existing tracks of the playlist before writing the matches
+	Replace bool
+	// Makes a new playlist public
+	Public bool
+}
+
+// The playlist to which search results were written
+type PlaylistResult struct {
+	ID   string `json:"id"`
+	URI  string `json:"uri"`
+	Name string `json:"name"`
+	// The number of matching tracks
+	Matched int `json:"matched"`
+	// The number of tracks added, which excludes matches already in the playlist
+	Added int `json:"added"`
+}
+
+// Writes every track matching a search, up to the size limit of a playlist, to one of the user's playlists. The search
+// is restricted to the user's indexed tracks, optionally only those found in the given sources
+func (u *activeUser) WriteSearchToPlaylist(ctx context.Context, search TrackSearch, sourceFilter []string, target PlaylistTarget) (PlaylistResult, error) {
+	target.PlaylistID = NormalizeSpotifyID("playlist", target.PlaylistID)
+	if (target.Name == "") == (target.PlaylistID == "") {
+		return PlaylistResult{}, errors.New("either a new playlist name or an existing playlist ID is required")
+	}
+	var trackIDs []spotify.ID
+	if search.TrackIDs = u.IndexedTrackIDs(sourceFilter); len(search.TrackIDs) > 0 {
+		tracks, _, err := SearchAllTracks(ctx, search, maxPlaylistTracks)
+		if err != nil {
+			return PlaylistResult{}, err
+		}
+		for _, track := range tracks {
+			trackIDs = append(trackIDs, track.ID)
+		}
+	}
+
+	client := u.Client()
+	var playlist *spotify.FullPlaylist
+	var err error
+	if target.PlaylistID != "" {
+		playlist, err = client.GetPlaylist(spotify.ID(target.PlaylistID))
+	} else {
+		var user *spotify.PrivateUser
+		user, err = client.CurrentUser()
+		if err != nil {
+			return PlaylistResult{}, err
+		}
+		description := fmt.Sprintf("Songs with lyrics matching \"%s\", found by Versefind", search.Query)
+		playlist, err = client.CreatePlaylistForUser(user.ID, target.Name, description, target.Public)
+	}
+	if err != nil {
+		return PlaylistResult{}, err
+	}
+	result := PlaylistResult{ID: playlist.ID.String(), URI: string(playlist.URI), Name: playlist.Name, Matched: len(trackIDs)}
+
+	// Tracks already in the playlist are not added again
+	toAdd := trackIDs
+	if target.PlaylistID != "" && !target.Replace {
+		existing, err := playlistTrackIDs(client, playlist.ID)
+		if err != nil {
+			return PlaylistResult{}, err
+		}
+		toAdd = nil
+		for _, id := range trackIDs {
+			if !existing[id] {
+				toAdd = append(toAdd, id)
+			}
+		}
+	}
+
+	for start := 0; start < len(toAdd) || (start == 0 && target.Replace); start += playlistBatchSize {
+		end := start + playlistBatchSize
+		if end > len(toAdd) {
+			end = len(toAdd)
+		}
+		// Replacing the tracks with the first batch clears the playlist, even when there are no matches
+		if start == 0 && target.Replace {
+			err = client.ReplacePlaylistTracks(playlist.ID, toAdd[start:end]...)
+		} else {
+			_, err = client.AddTracksToPlaylist(playlist.ID, toAdd[start:end]...)
+		}
+		if err != nil {
+			return result, fmt.Errorf("could not add tracks to playlist %s: %w", playlist.ID, err)
+		}
+		result.Added = end
+	}
+	return result, nil
+}
+
+// Fetches the IDs of the tracks already in a playlist
+func playlistTrackIDs(client spotify.Client, playlistID spotify.ID) (map[spotify.ID]bool, error) {
+	trackIDs := map[spotify.ID]bool{}
+	trackPage, err := client.GetPlaylistTracks(playlistID)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		for _, playlistTrack := range trackPage.Tracks {
+			trackIDs[playlistTrack.Track.ID] = true
+		}
+		err = client.NextPage(trackPage)
+		if errors.Is(err, spotify.ErrNoMorePages) {
+			return trackIDs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Writes the tracks matching a search to a new or existing Spotify playlist of the user's. Takes the search parameters
+// of the search endpoint other than limit and offset, along with either a new playlist's name or an existing
+// playlist's ID
+func playlistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "", 405)
+		return
+	}
+	if !fromSameOrigin(r) {
+		log.Warnf("rejected %s request to %s from origin %s", r.Method, r.URL.Path, r.Header.Get("Origin"))
+		http.Error(w, "", 403)
+		return
+	}
+	user, err := getUserBySession(r, w.Header())
+	if err != nil {
+		log.Errorf("could not get spotify client: %s", err.Error())
+		http.Error(w, "", 403)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "", 400)
+		return
+	}
+	search, err := parseSearchQuery(r.Form)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		writeJSONError(w, 400, validationErr)
+		return
+	}
+	target := PlaylistTarget{Name: r.Form.Get("name"), PlaylistID: r.Form.Get("playlist")}
+	if (target.Name == "") == (target.PlaylistID == "") {
+		writeJSONError(w, 400, &ValidationError{Field: "name", Message: "exactly one of name and playlist is required"})
+		return
+	}
+	for _, flag := range []struct {
+		field string
+		value *bool
+	}{
+		{"replace", &target.Replace},
+		{"public", &target.Public},
+	} {
+		if raw := r.Form.Get(flag.field); raw != "" {
+			if *flag.value, err = strconv.ParseBool(raw); err != nil {
+				writeJSONError(w, 400, &ValidationError{Field: flag.field, Message: "must be true or false"})
+				return
+			}
+		}
+	}
+
+	log.Tracef("%s writing search for '%s' to playlist (name='%s', id='%s')", r.RemoteAddr, search.Query, target.Name, target.PlaylistID)
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	result, err := user.WriteSearchToPlaylist(ctx, search, r.Form["source"], target)
+	if user.ReauthRequired() {
+		http.Error(w, "", 403)
+		return
+	}
+	if errors.Is(err, ErrInvalidQuery) {
+		log.Infof("could not search tracks: %s", err.Error())
+		writeJSONError(w, 400, &ValidationError{Field: "q", Message: "could not be parsed"})
+		return
+	}
+	var spotifyErr spotify.Error
+	if errors.As(err, &spotifyErr) {
+		log.Infof("spotify refused playlist update: %s (status %d)", spotifyErr.Message, spotifyErr.Status)
+		switch spotifyErr.Status {
+		case 404:
+			writeJSONError(w, 404, &ValidationError{Field: "playlist", Message: "no such playlist was found"})
+		case 401, 403:
+			// Sessions created before playlist writing was added lack the scope, and only owners may edit playlists
+			writeJSONError(w, 403, &ValidationError{Field: "playlist", Message: "the playlist cannot be modified - log in again or choose a playlist you own"})
+		default:
+			writeJSONError(w, 502, &ValidationError{Field: "playlist", Message: spotifyErr.Message})
+		}
+		return
+	}
+	if err != nil {
+		log.Errorf("could not write search to playlist: %s", err.Error())
+		http.Error(w, "", 500)
+		return
+	}
+	respBytes, err := json.Marshal(result)
+	if err != nil {
+		log.Fatalf("could not marshal playlist response: %s", err.Error())
+	}
+	_, _ = w.Write(respBytes)
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// Every lyrics provider known to Versefind, in registration order
+	registeredProviders []LyricsProvider
+	// The enabled lyrics providers, in the order in which they are consulted
+	activeProviders []LyricsProvider
+)
+
+func init() {
+	RegisterProvider(&GeniusProvider{})
+	RegisterProvider(&AZLyricsProvider{})
+	RegisterProvider(&LRCLibProvider{})
+	activeProviders = registeredProviders
+}
+
+// The version of Versefind's lyric lookup, recorded with each track's lyrics. It is bumped whenever a change to the
+// providers or to match verification would find different lyrics, so that tracks indexed by older versions can be
+// found and re-fetched. Tracks indexed before lookups were versioned have version 0
+const scraperVersion = 2
+
+// Track metadata handed to a lyrics provider to look up a track
+type LyricsQuery struct {
+	Title    string
+	Artists  []string
+	Album    string
+	Duration time.Duration
+}
+
+// Lyrics found by a lyrics provider, along with their provenance
+type LyricsResult struct {
+	Lyrics string
+	// The lyrics in the LRC format, if the provider has them time-synced
+	SyncedLyrics string
+	Provider     string
+	URL          string
+	// How likely the provider's song is to be the track looked up, from 0 to 1
+	Confidence float64
+	// Set, without lyrics, if the provider knows the song to be an instrumental
+	Instrumental bool
+}
+
+// Where and when a track's lyrics were found, and how closely the provider's song matched the track, so that bad
+// lyrics can be traced and re-fetched. Tracks whose lyrics could not be found record when they will be looked for again
+type LyricsProvenance struct {
+	// The name of the provider the lyrics came from. Empty if no provider had lyrics for the track
+	Provider string `json:"provider,omitempty"`
+	// The page from which the lyrics were taken
+	URL string `json:"url,omitempty"`
+	// When the providers were consulted. Nil for tracks indexed before provenance was recorded
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	// The confidence with which the provider's song matched the track, from 0 to 1
+	Confidence     float64 `json:"confidence"`
+	ScraperVersion int     `json:"scraper_version"`
+	// One of LyricsStatuses. Empty for tracks indexed before lookup statuses were recorded
+	Status string `json:"status,omitempty"`
+	// The number of consecutive failed lookups
+	Attempts int `json:"attempts,omitempty"`
+	// When the lyrics are next looked for, if the lookup failed or found nothing
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+// A source of lyrics which can be consulted by IndexLyrics
+type LyricsProvider interface {
+	// A short unique name by which the provider is referred to in configuration
+	Name() string
+	// Looks up the lyrics of a track. Returns false without an error if the provider has no lyrics for the track, or
+	// none which match it with at least minMatchConfidence. Instrumentals are reported as found, without lyrics
+	Lookup(ctx context.Context, query LyricsQuery) (LyricsResult, bool, error)
+}
+
+// Builds the free-text search string with which most providers are queried
+func (q LyricsQuery) SearchText() string {
+	return q.Title + " " + strings.Join(q.Artists, " ")
+}
+
+// Makes a lyrics provider available for use. Providers are consulted in registration order unless configured otherwise
+func RegisterProvider(provider LyricsProvider) {
+	registeredProviders = append(registeredProviders, provider)
+}
+
+// Returns the names of all registered lyrics providers, in registration order
+func ProviderNames() []string {
+	var names []string
+	for _, provider := range registeredProviders {
+		names = append(names, provider.Name())
+	}
+	return names
+}
+
+// Configures which lyrics providers are consulted by IndexLyrics and in what order. Providers named in 'order' are
+// consulted first, followed by any remaining registered providers. Providers mapped to false in 'enabled' are skipped.
+func UseProviders(order []string, enabled map[string]bool) error {
+	byName := map[string]LyricsProvider{}
+	for _, provider := range registeredProviders {
+		byName[provider.Name()] = provider
+	}
+	for name := range enabled {
+		if _, ok := byName[name]; !ok {
+			return fmt.Errorf("unknown lyrics provider %s", name)
+		}
+	}
+
+	var providers []LyricsProvider
+	seen := map[string]bool{}
+	for _, name := range append(order, ProviderNames()...) {
+		name = strings.TrimSpace(name)
+		provider, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown lyrics provider %s", name)
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if isEnabled, ok := enabled[name]; ok && !isEnabled {
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	activeProviders = providers
+	return nil
+}
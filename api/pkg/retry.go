@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+	"time"
+)
+
+// The outcome of looking up a track's lyrics
+const (
+	// A provider had lyrics for the track
+	LyricsFound = "found"
+	// Every provider was consulted without error, and none had lyrics for the track
+	LyricsNotFound = "not_found"
+	// No provider had lyrics for the track, and at least one could not be consulted
+	LyricsFailed = "failed"
+	// The track has no vocals, so its lyrics are not looked for
+	LyricsInstrumental = "instrumental"
+)
+
+// The possible outcomes of a lyrics lookup
+var LyricsStatuses = []string{LyricsFound, LyricsNotFound, LyricsFailed, LyricsInstrumental}
+
+// Wrapped by the error of a lookup which failed once the track was already in the track store, either with lyrics from
+// an earlier lookup or as a record of the failure to be retried. Such a track can be treated as indexed
+var ErrLookupFailed = errors.New("lyrics lookup failed")
+
+var (
+	// How long after a first failed lookup it is retried. Each further consecutive failure doubles the delay
+	failedRetryDelay = time.Minute * 15
+	// The longest delay between retries of failed lookups
+	maxFailedRetryDelay = time.Hour * 24 * 7
+	// How often tracks without lyrics are looked up again, as providers add lyrics over time
+	notFoundRecheckInterval = time.Hour * 24 * 30
+	// How often the track store is checked for lookups due to be retried
+	retryPollInterval = time.Minute * 15
+)
+
+// The most lookups retried each time the track store is polled
+const retryBatchSize = 500
+
+// Sets how often tracks for which no provider had lyrics are looked up again. Zero disables re-checks
+func SetNotFoundRecheckInterval(interval time.Duration) {
+	notFoundRecheckInterval = interval
+}
+
+// Reports whether a valid lyrics status name is given
+func IsLyricsStatus(name string) bool {
+	for _, status := range LyricsStatuses {
+		if status == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Records the outcome of a lookup which did not fail, scheduling a re-check if no lyrics were found
+func (p *LyricsProvenance) recordLookup(status string, now time.Time) {
+	p.Status = status
+	p.Attempts = 0
+	p.RetryAt = nil
+	if status == LyricsNotFound && notFoundRecheckInterval > 0 {
+		retryAt := now.Add(notFoundRecheckInterval)
+		p.RetryAt = &retryAt
+	}
+}
+
+// Records a failed lookup, the 'attempts'th in a row, scheduling a retry with exponential backoff
+func (p *LyricsProvenance) recordFailure(attempts int, now time.Time) {
+	p.Status = LyricsFailed
+	p.Attempts = attempts
+	delay := failedRetryDelay
+	for i := 1; i < attempts && delay < maxFailedRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxFailedRetryDelay {
+		delay = maxFailedRetryDelay
+	}
+	retryAt := now.Add(delay)
+	p.RetryAt = &retryAt
+}
+
+// Reports whether the track's lyrics should be looked up again. Tracks indexed before lookup statuses were recorded
+// are due if they have no lyrics, and tracks without lyrics are only due when a re-check was scheduled for them
+func (t VerseTrack) lookupDue(now time.Time) bool {
+	switch t.Provenance.Status {
+	case LyricsFound, LyricsInstrumental:
+		return false
+	case "":
+		return t.Lyrics == ""
+	case LyricsNotFound:
+		return t.Provenance.RetryAt != nil && !t.Provenance.RetryAt.After(now)
+	default:
+		return t.Provenance.RetryAt == nil || !t.Provenance.RetryAt.After(now)
+	}
+}
+
+// Periodically looks up the lyrics of tracks whose last lookup failed or found nothing, once their retry is due, so
+// that tracks outside any active user's library are retried too
+func retryLookups() {
+	for {
+		time.Sleep(retryPollInterval)
+		now := time.Now()
+		ctx := context.Background()
+		results, err := SearchTracks(ctx, TrackSearch{
+			Query:   "*",
+			Mode:    SearchModeQuery,
+			Filters: TrackFilters{RetryDueBy: &now},
+			Limit:   retryBatchSize,
+		})
+		if err != nil {
+			log.Warnf("could not find lyrics lookups to retry: %s", err.Error())
+			continue
+		}
+		if len(results.Results) == 0 {
+			continue
+		}
+		log.Infof("retrying lyrics lookups for %d of %d tracks", len(results.Results), results.Total)
+		var tracks []spotify.FullTrack
+		for _, hit := range results.Results {
+			tracks = append(tracks, hit.Spotify)
+		}
+		IndexTracks(ctx, tracks, nil, func(track spotify.FullTrack, err error) {
+			if err != nil {
+				log.Debugf("retried lyrics lookup for %s failed: %s", track.ID, err.Error())
+				return
+			}
+			// Saved searches were run against the track while it had no lyrics, so they are run again now it has some
+			retried, err := store.GetTrack(ctx, track.ID.String())
+			if err != nil {
+				log.Warnf("could not check retried lyrics lookup for %s: %s", track.ID, err.Error())
+				return
+			}
+			if retried != nil && retried.Provenance.Status == LyricsFound {
+				matchSavedSearchesOfLibraries(ctx, track.ID.String())
+			}
+		})
+	}
+}
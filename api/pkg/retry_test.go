@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordLookup(t *testing.T) {
+	defer SetNotFoundRecheckInterval(notFoundRecheckInterval)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name            string
+		status          string
+		recheckInterval time.Duration
+		expectedRetryAt *time.Time
+		dueAt           time.Time
+		expectedDue     bool
+	}{
+		{"found", LyricsFound, time.Hour, nil, now.Add(time.Hour * 24 * 365), false},
+		{"instrumental", LyricsInstrumental, time.Hour, nil, now.Add(time.Hour * 24 * 365), false},
+		{"not found before re-check", LyricsNotFound, time.Hour, timePointer(now.Add(time.Hour)), now.Add(time.Minute), false},
+		{"not found after re-check", LyricsNotFound, time.Hour, timePointer(now.Add(time.Hour)), now.Add(time.Hour), true},
+		{"not found with re-checks disabled", LyricsNotFound, 0, nil, now.Add(time.Hour * 24 * 365), false},
+	} {
+		SetNotFoundRecheckInterval(tc.recheckInterval)
+		track := VerseTrack{Provenance: LyricsProvenance{Status: LyricsFailed, Attempts: 3}}
+		track.Provenance.recordLookup(tc.status, now)
+		if track.Provenance.Status != tc.status || track.Provenance.Attempts != 0 {
+			t.Errorf("%s: recorded status %s after %d attempts, expected %s after 0", tc.name, track.Provenance.Status, track.Provenance.Attempts, tc.status)
+		}
+		if !timesEqual(track.Provenance.RetryAt, tc.expectedRetryAt) {
+			t.Errorf("%s: retry at %v, expected %v", tc.name, track.Provenance.RetryAt, tc.expectedRetryAt)
+		}
+		if due := track.lookupDue(tc.dueAt); due != tc.expectedDue {
+			t.Errorf("%s: due at %s is %t, expected %t", tc.name, tc.dueAt, due, tc.expectedDue)
+		}
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		attempts      int
+		expectedDelay time.Duration
+	}{
+		{1, failedRetryDelay},
+		{2, failedRetryDelay * 2},
+		{3, failedRetryDelay * 4},
+		{10, failedRetryDelay * 512},
+		{11, maxFailedRetryDelay},
+		{100, maxFailedRetryDelay},
+	} {
+		var track VerseTrack
+		track.Provenance.recordFailure(tc.attempts, now)
+		if track.Provenance.Status != LyricsFailed || track.Provenance.Attempts != tc.attempts {
+			t.Errorf("attempt %d: recorded status %s after %d attempts", tc.attempts, track.Provenance.Status, track.Provenance.Attempts)
+		}
+		expected := now.Add(tc.expectedDelay)
+		if !timesEqual(track.Provenance.RetryAt, &expected) {
+			t.Errorf("attempt %d: retry at %v, expected %s", tc.attempts, track.Provenance.RetryAt, expected)
+		}
+		if track.lookupDue(expected.Add(-time.Second)) || !track.lookupDue(expected) {
+			t.Errorf("attempt %d: not due exactly from %s", tc.attempts, expected)
+		}
+	}
+}
+
+func timePointer(t time.Time) *time.Time {
+	return &t
+}
+
+func timesEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,353 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// The most searches a user can save
+	maxSavedSearches = 50
+	// The most saved search matches kept for a user until they are next sent. The oldest are dropped beyond this, so
+	// that a user who never connects cannot grow the queue without bound
+	maxPendingMatches = 200
+)
+
+// The address ranges webhooks may not be posted to, so that saved searches cannot be used to reach services on the
+// server's own network. Loopback, link-local, multicast and unspecified addresses are rejected as well
+var webhookBlockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"fc00::/7",
+)
+
+// The client with which webhooks are posted. Addresses are checked as they are dialled, after name resolution, so that
+// a hostname resolving to a blocked address is caught however it resolves at the time. Proxies are not used, as the
+// proxy rather than the webhook would be dialled
+var webhookClient = &http.Client{
+	Timeout: time.Second * 5,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: time.Second * 5,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || webhookAddressBlocked(ip) {
+					return fmt.Errorf("webhook address %s is not publicly routable", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: time.Second * 5,
+	},
+}
+
+// A search saved by a user, which is run against each track newly indexed in their library so that they can be
+// notified of matches
+type SavedSearch struct {
+	ID      string       `json:"id"`
+	Query   string       `json:"query"`
+	Mode    string       `json:"mode"`
+	Filters TrackFilters `json:"filters"`
+	// Restricts matches to tracks found in any of these library sources, if there are any
+	Sources []string `json:"sources,omitempty"`
+	// A URL to which matches are also posted as JSON
+	Webhook   string    `json:"webhook,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// A newly indexed track in a user's library which matched one of their saved searches
+type SavedSearchMatch struct {
+	SearchID string    `json:"search_id"`
+	Query    string    `json:"query"`
+	Hit      SearchHit `json:"hit"`
+}
+
+// Runs each of the user's saved searches against a track newly added to their library, queueing a notification for
+// every match to be sent with the next progress report and posting it to the search's webhook if it has one
+func (u *activeUser) MatchSavedSearches(ctx context.Context, trackID string, trackSources []TrackSource) {
+	for _, saved := range u.SavedSearches() {
+		if len(saved.Sources) > 0 && !hasAnySource(trackSources, saved.Sources) {
+			continue
+		}
+		results, err := SearchTracks(ctx, TrackSearch{
+			Query:    saved.Query,
+			Mode:     saved.Mode,
+			Filters:  saved.Filters,
+			TrackIDs: []string{trackID},
+			Limit:    1,
+		})
+		if err != nil {
+			log.Warnf("could not run saved search %s against %s: %s", saved.ID, trackID, err.Error())
+			continue
+		}
+		if len(results.Results) == 0 {
+			continue
+		}
+		hit := results.Results[0]
+		hit.Sources = trackSources
+		hit.trimForResponse(nil)
+		match := SavedSearchMatch{SearchID: saved.ID, Query: saved.Query, Hit: hit}
+		log.Debugf("track %s matched saved search %s for session %s", trackID, saved.ID, u.session)
+		u.savedSearchMutex.Lock()
+		u.pendingMatches = append(u.pendingMatches, match)
+		u.trimPendingMatches()
+		u.savedSearchMutex.Unlock()
+		if saved.Webhook != "" {
+			go postWebhook(saved.Webhook, match)
+		}
+	}
+}
+
+// Runs the saved searches of every active user with the track in their library against it, for a track whose lyrics
+// were found after it joined their libraries
+func matchSavedSearchesOfLibraries(ctx context.Context, trackID string) {
+	activeUsers.Range(func(key, value interface{}) bool {
+		user := value.(*activeUser)
+		if trackSources, ok := user.indexedTracks.Load(trackID); ok {
+			user.MatchSavedSearches(ctx, trackID, trackSources.([]TrackSource))
+		}
+		return true
+	})
+}
+
+// Returns a copy of the user's saved searches
+func (u *activeUser) SavedSearches() []SavedSearch {
+	u.savedSearchMutex.Lock()
+	defer u.savedSearchMutex.Unlock()
+	return append([]SavedSearch{}, u.savedSearches...)
+}
+
+// Saves a search for the user, assigning it an id
+func (u *activeUser) AddSavedSearch(search SavedSearch) (SavedSearch, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return search, fmt.Errorf("could not generate saved search id: %w", err)
+	}
+	search.ID = hex.EncodeToString(idBytes)
+	search.CreatedAt = time.Now()
+
+	u.savedSearchMutex.Lock()
+	defer u.savedSearchMutex.Unlock()
+	if len(u.savedSearches) >= maxSavedSearches {
+		return search, &ValidationError{Field: "q", Message: fmt.Sprintf("no more than %d searches can be saved", maxSavedSearches)}
+	}
+	if err := sessions.PutSavedSearch(u.session, search); err != nil {
+		return search, fmt.Errorf("could not persist saved search: %w", err)
+	}
+	u.savedSearches = append(u.savedSearches, search)
+	return search, nil
+}
+
+// Deletes one of the user's saved searches, reporting whether it existed
+func (u *activeUser) DeleteSavedSearch(searchID string) (bool, error) {
+	u.savedSearchMutex.Lock()
+	defer u.savedSearchMutex.Unlock()
+	for idx, search := range u.savedSearches {
+		if search.ID != searchID {
+			continue
+		}
+		if err := sessions.DeleteSavedSearch(u.session, searchID); err != nil {
+			return true, fmt.Errorf("could not delete saved search: %w", err)
+		}
+		u.savedSearches = append(u.savedSearches[:idx], u.savedSearches[idx+1:]...)
+		return true, nil
+	}
+	return false, nil
+}
+
+// Removes and returns the saved search matches not yet sent to the user
+func (u *activeUser) takePendingMatches() []SavedSearchMatch {
+	u.savedSearchMutex.Lock()
+	defer u.savedSearchMutex.Unlock()
+	matches := u.pendingMatches
+	u.pendingMatches = nil
+	return matches
+}
+
+// Puts back saved search matches which could not be sent, ahead of any queued since
+func (u *activeUser) requeueMatches(matches []SavedSearchMatch) {
+	u.savedSearchMutex.Lock()
+	defer u.savedSearchMutex.Unlock()
+	u.pendingMatches = append(matches, u.pendingMatches...)
+	u.trimPendingMatches()
+}
+
+// Drops the oldest pending matches beyond maxPendingMatches. The saved search mutex must be held
+func (u *activeUser) trimPendingMatches() {
+	if excess := len(u.pendingMatches) - maxPendingMatches; excess > 0 {
+		log.Debugf("dropping %d unsent saved search matches for session %s", excess, u.session)
+		u.pendingMatches = append([]SavedSearchMatch{}, u.pendingMatches[excess:]...)
+	}
+}
+
+// Reports whether webhooks may not be posted to an address
+func webhookAddressBlocked(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range webhookBlockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("could not parse network %s: %s", cidr, err.Error())
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Posts a saved search match to a webhook as JSON. Failures are only logged
+func postWebhook(webhook string, match SavedSearchMatch) {
+	body, err := json.Marshal(match)
+	if err != nil {
+		log.Fatalf("could not marshal saved search match: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("could not construct webhook request: %s", err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		log.Warnf("could not post saved search match to webhook: %s", err.Error())
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warnf("webhook rejected saved search match: status %d", resp.StatusCode)
+	}
+}
+
+// Lists the user's saved searches (GET), saves a new search (POST) or deletes one by id (DELETE). New searches take
+// the query, mode and filter parameters of the search endpoint, along with optional source and webhook parameters
+func savedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && !fromSameOrigin(r) {
+		log.Warnf("rejected %s request to %s from origin %s", r.Method, r.URL.Path, r.Header.Get("Origin"))
+		http.Error(w, "", 403)
+		return
+	}
+	user, err := getUserBySession(r, w.Header())
+	if err != nil {
+		log.Errorf("could not get spotify client: %s", err.Error())
+		http.Error(w, "", 403)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "", 400)
+		return
+	}
+
+	var response interface{}
+	switch r.Method {
+	case http.MethodGet:
+		response = user.SavedSearches()
+	case http.MethodPost:
+		search, err := parseSavedSearchParams(r.Form)
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			writeJSONError(w, 400, validationErr)
+			return
+		}
+		// Check that the query can be run before saving it
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+		defer cancel()
+		_, err = SearchTracks(ctx, TrackSearch{Query: search.Query, Mode: search.Mode, Filters: search.Filters, TrackIDs: []string{}})
+		if errors.Is(err, ErrInvalidQuery) {
+			writeJSONError(w, 400, &ValidationError{Field: "q", Message: "could not be parsed"})
+			return
+		}
+		if err != nil {
+			log.Errorf("could not check saved search: %s", err.Error())
+			http.Error(w, "", 500)
+			return
+		}
+		search, err = user.AddSavedSearch(search)
+		if errors.As(err, &validationErr) {
+			writeJSONError(w, 400, validationErr)
+			return
+		}
+		if err != nil {
+			log.Errorf("could not save search: %s", err.Error())
+			http.Error(w, "", 500)
+			return
+		}
+		response = search
+	case http.MethodDelete:
+		found, err := user.DeleteSavedSearch(r.Form.Get("id"))
+		if err != nil {
+			log.Errorf("could not delete saved search: %s", err.Error())
+			http.Error(w, "", 500)
+			return
+		}
+		if !found {
+			writeJSONError(w, 404, &ValidationError{Field: "id", Message: "no such saved search"})
+			return
+		}
+		w.WriteHeader(204)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "", 405)
+		return
+	}
+	respBytes, err := json.Marshal(response)
+	if err != nil {
+		log.Fatalf("could not marshal saved searches response: %s", err.Error())
+	}
+	_, _ = w.Write(respBytes)
+}
+
+// Parses and validates the parameters of a new saved search
+func parseSavedSearchParams(params url.Values) (SavedSearch, error) {
+	search, err := parseSearchQuery(params)
+	if err != nil {
+		return SavedSearch{}, err
+	}
+	if search.Query == "" {
+		return SavedSearch{}, &ValidationError{Field: "q", Message: "is required"}
+	}
+	saved := SavedSearch{Query: search.Query, Mode: search.Mode, Filters: search.Filters, Sources: params["source"]}
+	if webhook := params.Get("webhook"); webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return SavedSearch{}, &ValidationError{Field: "webhook", Message: "must be an http or https URL"}
+		}
+		// Hostnames are checked when the webhook is posted to, as they may resolve differently by then
+		if ip := net.ParseIP(u.Hostname()); (ip != nil && webhookAddressBlocked(ip)) || strings.EqualFold(u.Hostname(), "localhost") {
+			return SavedSearch{}, &ValidationError{Field: "webhook", Message: "must be a publicly routable address"}
+		}
+		saved.Webhook = webhook
+	}
+	return saved, nil
+}
@@ -0,0 +1,278 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Restrictions on the Spotify metadata and lyric provenance of tracks matched by a search. Nil and empty fields do
+// not restrict
+type TrackFilters struct {
+	// Matched against the names of the track's artists
+	Artist string `json:"artist,omitempty"`
+	// Matched against the name of the track's album
+	Album         string `json:"album,omitempty"`
+	YearMin       *int   `json:"year_min,omitempty"`
+	YearMax       *int   `json:"year_max,omitempty"`
+	Explicit      *bool  `json:"explicit,omitempty"`
+	PopularityMin *int   `json:"popularity_min,omitempty"`
+	PopularityMax *int   `json:"popularity_max,omitempty"`
+	DurationMinMs *int   `json:"duration_min_ms,omitempty"`
+	DurationMaxMs *int   `json:"duration_max_ms,omitempty"`
+	// Restrict tracks by the provenance of their lyrics, for tracing and re-fetching bad lyrics
+	Provider          string     `json:"provider,omitempty"`
+	ConfidenceMin     *float64   `json:"confidence_min,omitempty"`
+	ConfidenceMax     *float64   `json:"confidence_max,omitempty"`
+	FetchedAfter      *time.Time `json:"fetched_after,omitempty"`
+	FetchedBefore     *time.Time `json:"fetched_before,omitempty"`
+	ScraperVersionMin *int       `json:"scraper_version_min,omitempty"`
+	ScraperVersionMax *int       `json:"scraper_version_max,omitempty"`
+	// One of LyricsStatuses
+	Status string `json:"status,omitempty"`
+	// Includes instrumental tracks, which are otherwise left out unless Status asks for them
+	IncludeInstrumental bool `json:"include_instrumental,omitempty"`
+	// Restricts tracks to those whose lyrics lookup failed or found nothing and is due to be retried by this time
+	RetryDueBy *time.Time `json:"-"`
+}
+
+// How far into a search's results a page may reach, as Elasticsearch refuses to page beyond its default
+// max_result_window
+const maxSearchWindow = 10000
+
+// An API request parameter which failed validation, reported to API clients as JSON
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Message)
+}
+
+// Parses and validates the parameters of a search request, other than the user's track restriction
+func parseSearchParams(params url.Values) (TrackSearch, error) {
+	search, err := parseSearchQuery(params)
+	if err != nil {
+		return search, err
+	}
+	if search.Limit, err = requiredInt(params, "limit", 0, maxSearchWindow); err != nil {
+		return search, err
+	}
+	if search.Offset, err = requiredInt(params, "offset", 0, maxSearchWindow); err != nil {
+		return search, err
+	}
+	if search.Offset+search.Limit > maxSearchWindow {
+		return search, &ValidationError{Field: "offset", Message: fmt.Sprintf("plus limit must be no more than %d", maxSearchWindow)}
+	}
+	return search, nil
+}
+
+// Parses and validates the query, mode and filters of a search request, leaving its paging unset
+func parseSearchQuery(params url.Values) (TrackSearch, error) {
+	search := TrackSearch{Query: params.Get("q"), Mode: params.Get("mode")}
+	if search.Mode == "" {
+		search.Mode = SearchModeQuery
+	}
+	if !IsSearchMode(search.Mode) {
+		return search, &ValidationError{Field: "mode", Message: fmt.Sprintf("must be one of %s", strings.Join(SearchModes, ", "))}
+	}
+	var err error
+	filters := &search.Filters
+	filters.Artist = params.Get("artist")
+	filters.Album = params.Get("album")
+	if filters.YearMin, err = optionalInt(params, "year_min", 0, 9999); err != nil {
+		return search, err
+	}
+	if filters.YearMax, err = optionalInt(params, "year_max", 0, 9999); err != nil {
+		return search, err
+	}
+	if filters.PopularityMin, err = optionalInt(params, "popularity_min", 0, 100); err != nil {
+		return search, err
+	}
+	if filters.PopularityMax, err = optionalInt(params, "popularity_max", 0, 100); err != nil {
+		return search, err
+	}
+	// Durations are given in seconds but matched against Spotify's duration in milliseconds
+	if filters.DurationMinMs, err = optionalInt(params, "duration_min", 0, 24*60*60); err != nil {
+		return search, err
+	}
+	if filters.DurationMaxMs, err = optionalInt(params, "duration_max", 0, 24*60*60); err != nil {
+		return search, err
+	}
+	for _, duration := range []*int{filters.DurationMinMs, filters.DurationMaxMs} {
+		if duration != nil {
+			*duration *= 1000
+		}
+	}
+	filters.Provider = params.Get("provider")
+	if filters.Status = params.Get("status"); filters.Status != "" && !IsLyricsStatus(filters.Status) {
+		return search, &ValidationError{Field: "status", Message: fmt.Sprintf("must be one of %s", strings.Join(LyricsStatuses, ", "))}
+	}
+	if filters.ConfidenceMin, err = optionalFloat(params, "confidence_min", 0, 1); err != nil {
+		return search, err
+	}
+	if filters.ConfidenceMax, err = optionalFloat(params, "confidence_max", 0, 1); err != nil {
+		return search, err
+	}
+	if filters.FetchedAfter, err = optionalTime(params, "fetched_after"); err != nil {
+		return search, err
+	}
+	if filters.FetchedBefore, err = optionalTime(params, "fetched_before"); err != nil {
+		return search, err
+	}
+	if filters.ScraperVersionMin, err = optionalInt(params, "scraper_version_min", 0, 1000); err != nil {
+		return search, err
+	}
+	if filters.ScraperVersionMax, err = optionalInt(params, "scraper_version_max", 0, 1000); err != nil {
+		return search, err
+	}
+	if value := params.Get("include_instrumental"); value != "" {
+		if filters.IncludeInstrumental, err = strconv.ParseBool(value); err != nil {
+			return search, &ValidationError{Field: "include_instrumental", Message: "must be true or false"}
+		}
+	}
+	if value := params.Get("explicit"); value != "" {
+		explicit, err := strconv.ParseBool(value)
+		if err != nil {
+			return search, &ValidationError{Field: "explicit", Message: "must be true or false"}
+		}
+		filters.Explicit = &explicit
+	}
+
+	for _, bounds := range []struct {
+		field    string
+		min, max *int
+	}{
+		{"year", filters.YearMin, filters.YearMax},
+		{"popularity", filters.PopularityMin, filters.PopularityMax},
+		{"duration", filters.DurationMinMs, filters.DurationMaxMs},
+		{"scraper_version", filters.ScraperVersionMin, filters.ScraperVersionMax},
+	} {
+		if bounds.min != nil && bounds.max != nil && *bounds.min > *bounds.max {
+			return search, &ValidationError{Field: bounds.field + "_min", Message: fmt.Sprintf("must not exceed %s_max", bounds.field)}
+		}
+	}
+	if filters.ConfidenceMin != nil && filters.ConfidenceMax != nil && *filters.ConfidenceMin > *filters.ConfidenceMax {
+		return search, &ValidationError{Field: "confidence_min", Message: "must not exceed confidence_max"}
+	}
+	if filters.FetchedAfter != nil && filters.FetchedBefore != nil && !filters.FetchedAfter.Before(*filters.FetchedBefore) {
+		return search, &ValidationError{Field: "fetched_after", Message: "must be before fetched_before"}
+	}
+	return search, nil
+}
+
+// The parts of a track's lyrics which search results only hold when asked for with the include parameter
+var SearchResultIncludes = []string{"stanzas", "synced_lyrics"}
+
+// Parses and validates the optional parts of the tracks to include in search results
+func parseSearchIncludes(params url.Values) (map[string]bool, error) {
+	include := map[string]bool{}
+	for _, name := range params["include"] {
+		valid := false
+		for _, option := range SearchResultIncludes {
+			valid = valid || option == name
+		}
+		if !valid {
+			return nil, &ValidationError{Field: "include", Message: fmt.Sprintf("must be one of %s", strings.Join(SearchResultIncludes, ", "))}
+		}
+		include[name] = true
+	}
+	return include, nil
+}
+
+// Removes the fields of a search hit which are only kept for searching, and the optional parts of its lyrics not
+// named in 'include', so that responses and notifications carry little more than the lyrics themselves
+func (h *SearchHit) trimForResponse(include map[string]bool) {
+	h.LyricsPhonetic = ""
+	if !include["stanzas"] {
+		h.Stanzas = nil
+	}
+	if !include["synced_lyrics"] {
+		h.SyncedLyrics = ""
+	}
+}
+
+func requiredInt(params url.Values, field string, min, max int) (int, error) {
+	if params.Get(field) == "" {
+		return 0, &ValidationError{Field: field, Message: "is required"}
+	}
+	value, err := optionalInt(params, field, min, max)
+	if err != nil {
+		return 0, err
+	}
+	return *value, nil
+}
+
+func optionalInt(params url.Values, field string, min, max int) (*int, error) {
+	raw := params.Get(field)
+	if raw == "" {
+		return nil, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, &ValidationError{Field: field, Message: "must be an integer"}
+	}
+	if value < min || value > max {
+		return nil, &ValidationError{Field: field, Message: fmt.Sprintf("must be between %d and %d", min, max)}
+	}
+	return &value, nil
+}
+
+func optionalFloat(params url.Values, field string, min, max float64) (*float64, error) {
+	raw := params.Get(field)
+	if raw == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, &ValidationError{Field: field, Message: "must be a number"}
+	}
+	if value < min || value > max {
+		return nil, &ValidationError{Field: field, Message: fmt.Sprintf("must be between %g and %g", min, max)}
+	}
+	return &value, nil
+}
+
+func optionalTime(params url.Values, field string) (*time.Time, error) {
+	raw := params.Get(field)
+	if raw == "" {
+		return nil, nil
+	}
+	value, err := ParseTime(raw)
+	if err != nil {
+		return nil, &ValidationError{Field: field, Message: "must be a date (YYYY-MM-DD) or an RFC 3339 timestamp"}
+	}
+	return &value, nil
+}
+
+// Parses an RFC 3339 timestamp, or a date alone meaning midnight UTC
+func ParseTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not parse time %s - expected a date (YYYY-MM-DD) or an RFC 3339 time", value)
+}
+
+// Reports whether instrumental tracks are left out of a search with these filters
+func (f TrackFilters) excludesInstrumentals() bool {
+	return !f.IncludeInstrumental && f.Status != LyricsInstrumental
+}
+
+// Responds to an API request with a JSON error body
+func writeJSONError(w http.ResponseWriter, status int, validationErr *ValidationError) {
+	respBytes, err := json.Marshal(validationErr)
+	if err != nil {
+		log.Fatalf("could not marshal error response: %s", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(respBytes)
+}
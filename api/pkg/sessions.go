@@ -0,0 +1,370 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/oauth2"
+	"time"
+)
+
+var (
+	// Maps session ids to their persisted session records
+	sessionsBucket = []byte("sessions")
+	// Holds one nested bucket per session id, mapping the ids of the session's indexed tracks to their library sources
+	indexedTracksBucket = []byte("indexed_tracks")
+	// Holds one nested bucket per session id, mapping the ids of the session's saved searches to the searches
+	savedSearchesBucket = []byte("saved_searches")
+)
+
+// A user session persisted across API restarts
+type StoredSession struct {
+	Session       string
+	Token         *oauth2.Token
+	CreatedAt     time.Time
+	LastSeen      time.Time
+	IndexedTracks map[string][]TrackSource
+	SavedSearches []SavedSearch
+	Sync          SyncState
+}
+
+// The on-disk representation of a session. The OAuth2 token is encrypted at rest
+type sessionRecord struct {
+	Token     []byte    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Sync      SyncState `json:"sync"`
+}
+
+// A durable store of user sessions, their OAuth2 tokens, indexed tracks and saved searches, kept in a local bbolt
+// database
+type SessionStore struct {
+	db   *bolt.DB
+	aead cipher.AEAD
+	ttl  time.Duration
+}
+
+// Opens (creating if needed) the session database at 'path'. Tokens are encrypted with a key derived from 'secret', and
+// sessions not seen for 'ttl' are considered expired
+func OpenSessionStore(path, secret string, ttl time.Duration) (*SessionStore, error) {
+	if secret == "" {
+		return nil, errors.New("a session encryption secret is required")
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize session cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize session cipher: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, fmt.Errorf("could not open session database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{sessionsBucket, indexedTracksBucket, savedSearchesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not initialize session database: %w", err)
+	}
+	log.Infof("opened session database at %s", path)
+	return &SessionStore{db: db, aead: aead, ttl: ttl}, nil
+}
+
+// Sets the SessionStore in which the API server persists sessions
+func UseSessionStore(sessionStore *SessionStore) {
+	sessions = sessionStore
+}
+
+// Creates or updates a session with the given token, marking it as seen now
+func (s *SessionStore) SaveSession(session string, token *oauth2.Token) error {
+	tokenJson, err := json.Marshal(token)
+	if err != nil {
+		log.Fatalf("could not marshal oauth token: %s", err.Error())
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("could not generate nonce: %w", err)
+	}
+	encrypted := s.aead.Seal(nonce, nonce, tokenJson, []byte(session))
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		now := time.Now()
+		record := sessionRecord{CreatedAt: now}
+		if existing := bucket.Get([]byte(session)); existing != nil {
+			if err := json.Unmarshal(existing, &record); err != nil {
+				return fmt.Errorf("could not unmarshal session record: %w", err)
+			}
+		}
+		record.Token = encrypted
+		record.LastSeen = now
+		return putSessionRecord(bucket, session, record)
+	})
+}
+
+// Marks a session as seen now, extending its expiry
+func (s *SessionStore) TouchSession(session string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		existing := bucket.Get([]byte(session))
+		if existing == nil {
+			return nil
+		}
+		var record sessionRecord
+		if err := json.Unmarshal(existing, &record); err != nil {
+			return fmt.Errorf("could not unmarshal session record: %w", err)
+		}
+		record.LastSeen = time.Now()
+		return putSessionRecord(bucket, session, record)
+	})
+}
+
+// Records the state of a session's latest library sync
+func (s *SessionStore) SaveSyncState(session string, state SyncState) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		existing := bucket.Get([]byte(session))
+		if existing == nil {
+			return nil
+		}
+		var record sessionRecord
+		if err := json.Unmarshal(existing, &record); err != nil {
+			return fmt.Errorf("could not unmarshal session record: %w", err)
+		}
+		record.Sync = state
+		return putSessionRecord(bucket, session, record)
+	})
+}
+
+// Records that a track has been indexed for a session, along with where in the user's library it was found
+func (s *SessionStore) AddIndexedTrack(session, trackID string, trackSources []TrackSource) error {
+	return s.AddIndexedTracks(session, map[string][]TrackSource{trackID: trackSources})
+}
+
+// Records that several tracks have been indexed for a session, each mapped to where in the user's library it was found
+func (s *SessionStore) AddIndexedTracks(session string, tracks map[string][]TrackSource) error {
+	values := map[string][]byte{}
+	for trackID, trackSources := range tracks {
+		value, err := json.Marshal(trackSources)
+		if err != nil {
+			log.Fatalf("could not marshal track sources: %s", err.Error())
+		}
+		values[trackID] = value
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(indexedTracksBucket).CreateBucketIfNotExists([]byte(session))
+		if err != nil {
+			return err
+		}
+		for trackID, value := range values {
+			if err := bucket.Put([]byte(trackID), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Removes tracks which are no longer in a session's library from its indexed track set
+func (s *SessionStore) RemoveIndexedTracks(session string, trackIDs []string) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(indexedTracksBucket).Bucket([]byte(session))
+		if bucket == nil {
+			return nil
+		}
+		for _, trackID := range trackIDs {
+			if err := bucket.Delete([]byte(trackID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Creates or replaces one of a session's saved searches
+func (s *SessionStore) PutSavedSearch(session string, search SavedSearch) error {
+	value, err := json.Marshal(search)
+	if err != nil {
+		log.Fatalf("could not marshal saved search: %s", err.Error())
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(savedSearchesBucket).CreateBucketIfNotExists([]byte(session))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(search.ID), value)
+	})
+}
+
+// Deletes one of a session's saved searches, if it exists
+func (s *SessionStore) DeleteSavedSearch(session, searchID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(savedSearchesBucket).Bucket([]byte(session))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(searchID))
+	})
+}
+
+// Loads a single unexpired session, returning nil if it does not exist
+func (s *SessionStore) LoadSession(session string) (*StoredSession, error) {
+	var stored *StoredSession
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(sessionsBucket).Get([]byte(session))
+		if value == nil {
+			return nil
+		}
+		var err error
+		stored, err = s.loadSession(tx, session, value)
+		return err
+	})
+	return stored, err
+}
+
+// Loads every unexpired session
+func (s *SessionStore) LoadSessions() ([]*StoredSession, error) {
+	var stored []*StoredSession
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(key, value []byte) error {
+			session, err := s.loadSession(tx, string(key), value)
+			if err != nil {
+				log.Warnf("could not load session: %s", err.Error())
+				return nil
+			}
+			if session != nil {
+				stored = append(stored, session)
+			}
+			return nil
+		})
+	})
+	return stored, err
+}
+
+// Deletes a session, its indexed track set and its saved searches
+func (s *SessionStore) DeleteSession(session string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteSession(tx, session)
+	})
+}
+
+// Deletes every session not seen within the TTL, returning the deleted session ids
+func (s *SessionStore) DeleteExpired() ([]string, error) {
+	var expired []string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(sessionsBucket).ForEach(func(key, value []byte) error {
+			var record sessionRecord
+			if err := json.Unmarshal(value, &record); err != nil || s.isExpired(record) {
+				expired = append(expired, string(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, session := range expired {
+			if err := deleteSession(tx, session); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return expired, err
+}
+
+func (s *SessionStore) Close() error {
+	return s.db.Close()
+}
+
+// Decodes a session record and its indexed tracks. Expired sessions yield nil
+func (s *SessionStore) loadSession(tx *bolt.Tx, session string, value []byte) (*StoredSession, error) {
+	var record sessionRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, fmt.Errorf("could not unmarshal session record: %w", err)
+	}
+	if s.isExpired(record) {
+		return nil, nil
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(record.Token) < nonceSize {
+		return nil, errors.New("session token is truncated")
+	}
+	tokenJson, err := s.aead.Open(nil, record.Token[:nonceSize], record.Token[nonceSize:], []byte(session))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt session token: %w", err)
+	}
+	stored := &StoredSession{
+		Session:       session,
+		CreatedAt:     record.CreatedAt,
+		LastSeen:      record.LastSeen,
+		IndexedTracks: map[string][]TrackSource{},
+		Sync:          record.Sync,
+	}
+	if err := json.Unmarshal(tokenJson, &stored.Token); err != nil {
+		return nil, fmt.Errorf("could not unmarshal session token: %w", err)
+	}
+	if tracks := tx.Bucket(indexedTracksBucket).Bucket([]byte(session)); tracks != nil {
+		_ = tracks.ForEach(func(key, value []byte) error {
+			var trackSources []TrackSource
+			if err := json.Unmarshal(value, &trackSources); err != nil || len(trackSources) == 0 {
+				// Tracks recorded before library sources were tracked all came from the user's saved tracks
+				trackSources = []TrackSource{{Type: "saved"}}
+			}
+			stored.IndexedTracks[string(key)] = trackSources
+			return nil
+		})
+	}
+	if searches := tx.Bucket(savedSearchesBucket).Bucket([]byte(session)); searches != nil {
+		_ = searches.ForEach(func(key, value []byte) error {
+			var search SavedSearch
+			if err := json.Unmarshal(value, &search); err != nil {
+				log.Warnf("could not unmarshal saved search %s: %s", key, err.Error())
+				return nil
+			}
+			stored.SavedSearches = append(stored.SavedSearches, search)
+			return nil
+		})
+	}
+	return stored, nil
+}
+
+func (s *SessionStore) isExpired(record sessionRecord) bool {
+	return time.Since(record.LastSeen) > s.ttl
+}
+
+func putSessionRecord(bucket *bolt.Bucket, session string, record sessionRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		log.Fatalf("could not marshal session record: %s", err.Error())
+	}
+	return bucket.Put([]byte(session), value)
+}
+
+func deleteSession(tx *bolt.Tx, session string) error {
+	if err := tx.Bucket(sessionsBucket).Delete([]byte(session)); err != nil {
+		return err
+	}
+	for _, bucket := range [][]byte{indexedTracksBucket, savedSearchesBucket} {
+		err := tx.Bucket(bucket).DeleteBucket([]byte(session))
+		if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"strings"
+)
+
+// A line of lyrics
+type LyricLine struct {
+	// The zero-based index of the line within the lyrics text
+	Index int    `json:"index"`
+	Text  string `json:"text"`
+	// The offset of the line into the track in milliseconds, if the lyrics are time-synced
+	StartMs *int `json:"start_ms,omitempty"`
+}
+
+// A run of lyric lines between blank lines or section headers, named by the section header before it if there is one
+type LyricStanza struct {
+	// The section name from a header such as [Chorus] or [Verse 1: Artist], without the brackets
+	Section string      `json:"section,omitempty"`
+	Lines   []LyricLine `json:"lines"`
+}
+
+// Splits lyrics into stanzas. Blank lines end a stanza, and section headers start a new one. A section continues across
+// blank lines until the next header
+func parseStanzas(lyrics string) []LyricStanza {
+	var stanzas []LyricStanza
+	section := ""
+	var current *LyricStanza
+	for idx, line := range strings.Split(lyrics, "\n") {
+		text := strings.TrimSpace(line)
+		if header, ok := sectionHeader(text); ok {
+			section = header
+			current = nil
+			continue
+		}
+		if text == "" {
+			current = nil
+			continue
+		}
+		if current == nil {
+			stanzas = append(stanzas, LyricStanza{Section: section})
+			current = &stanzas[len(stanzas)-1]
+		}
+		current.Lines = append(current.Lines, LyricLine{Index: idx, Text: text})
+	}
+	return stanzas
+}
+
+// Recognises a section header line such as [Chorus], returning the section name
+func sectionHeader(line string) (string, bool) {
+	if len(line) < 3 || line[0] != '[' || line[len(line)-1] != ']' {
+		return "", false
+	}
+	return strings.TrimSpace(line[1 : len(line)-1]), true
+}
+
+// Finds the stanza containing the line at the given index of the lyrics text. Returns -1 if the line is not part of a
+// stanza, such as a blank line or a section header
+func stanzaOfLine(stanzas []LyricStanza, lineIdx int) int {
+	for stanzaIdx, stanza := range stanzas {
+		if len(stanza.Lines) == 0 || stanza.Lines[len(stanza.Lines)-1].Index < lineIdx {
+			continue
+		}
+		if stanza.Lines[0].Index <= lineIdx {
+			return stanzaIdx
+		}
+		return -1
+	}
+	return -1
+}
+
+// Finds the line at the given index of the lyrics text within a stanza
+func stanzaLine(stanza LyricStanza, lineIdx int) (LyricLine, bool) {
+	for _, line := range stanza.Lines {
+		if line.Index == lineIdx {
+			return line, true
+		}
+	}
+	return LyricLine{}, false
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStanzas(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		lyrics   string
+		expected []LyricStanza
+	}{
+		{
+			"blank lines",
+			"one\ntwo\n\nthree",
+			[]LyricStanza{
+				{Lines: []LyricLine{{Index: 0, Text: "one"}, {Index: 1, Text: "two"}}},
+				{Lines: []LyricLine{{Index: 3, Text: "three"}}},
+			},
+		},
+		{
+			"section headers",
+			"[Verse 1]\none\n[Chorus]\ntwo",
+			[]LyricStanza{
+				{Section: "Verse 1", Lines: []LyricLine{{Index: 1, Text: "one"}}},
+				{Section: "Chorus", Lines: []LyricLine{{Index: 3, Text: "two"}}},
+			},
+		},
+		{
+			"header variants",
+			"[Chorus: Artist & Other]\none\n\n  [ Pre-Chorus ]  \ntwo\n[]\n[Outro",
+			[]LyricStanza{
+				{Section: "Chorus: Artist & Other", Lines: []LyricLine{{Index: 1, Text: "one"}}},
+				{Section: "Pre-Chorus", Lines: []LyricLine{{Index: 4, Text: "two"}, {Index: 5, Text: "[]"}, {Index: 6, Text: "[Outro"}}},
+			},
+		},
+		{
+			"section continues across blank lines",
+			"[Chorus]\none\n\ntwo",
+			[]LyricStanza{
+				{Section: "Chorus", Lines: []LyricLine{{Index: 1, Text: "one"}}},
+				{Section: "Chorus", Lines: []LyricLine{{Index: 3, Text: "two"}}},
+			},
+		},
+		{
+			"untitled lines before the first header",
+			"intro\n[Verse]\none",
+			[]LyricStanza{
+				{Lines: []LyricLine{{Index: 0, Text: "intro"}}},
+				{Section: "Verse", Lines: []LyricLine{{Index: 2, Text: "one"}}},
+			},
+		},
+		{"empty", "", nil},
+		{"only headers", "[Instrumental]\n\n[Outro]", nil},
+	} {
+		if stanzas := parseStanzas(tc.lyrics); !reflect.DeepEqual(stanzas, tc.expected) {
+			t.Errorf("%s: parseStanzas(%q) = %+v, expected %+v", tc.name, tc.lyrics, stanzas, tc.expected)
+		}
+	}
+}
+
+func TestStanzaOfLine(t *testing.T) {
+	stanzas := parseStanzas("[Verse]\none\ntwo\n\n[Chorus]\nthree")
+	for _, tc := range []struct {
+		line     int
+		expected int
+	}{
+		{0, -1},
+		{1, 0},
+		{2, 0},
+		{3, -1},
+		{4, -1},
+		{5, 1},
+		{6, -1},
+	} {
+		if stanza := stanzaOfLine(stanzas, tc.line); stanza != tc.expected {
+			t.Errorf("stanzaOfLine(%d) = %d, expected %d", tc.line, stanza, tc.expected)
+		}
+	}
+}
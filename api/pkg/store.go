@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zmb3/spotify"
+)
+
+// Returned (wrapped) by a TrackStore when a search query cannot be parsed or executed as written
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// A storage backend in which indexed tracks and their lyrics are kept and searched
+type TrackStore interface {
+	// Returns the indexed track with the given Spotify ID, or nil if it has not been indexed
+	GetTrack(ctx context.Context, spotifyID string) (*VerseTrack, error)
+	// Inserts or replaces an indexed track
+	PutTrack(ctx context.Context, track VerseTrack) error
+	// Runs a lyric search against the indexed tracks
+	Search(ctx context.Context, search TrackSearch) (SearchResults, error)
+	// Calls 'fn' with every indexed track, stopping at the first error
+	ForEachTrack(ctx context.Context, fn func(track VerseTrack) error) error
+	// Releases any resources held by the store
+	Close() error
+}
+
+// How a search query is interpreted
+const (
+	// The query is in Lucene query string syntax, and every clause must match
+	SearchModeQuery = "query"
+	// The query must appear in the lyrics word for word
+	SearchModeExact = "exact"
+	// The words of the query must appear close together and in roughly the same order
+	SearchModePhrase = "phrase"
+	// Most words of the query must appear, allowing for misspellings
+	SearchModeFuzzy = "fuzzy"
+	// Combines the exact, phrase and fuzzy modes for half-remembered lines, ranking closer matches first
+	SearchModeSmart = "smart"
+	// Extends the smart mode with words which sound like those of the query, for misheard lines. Only the lyrics are
+	// searched
+	SearchModePhonetic = "phonetic"
+)
+
+// The supported search modes
+var SearchModes = []string{SearchModeQuery, SearchModeExact, SearchModePhrase, SearchModeFuzzy, SearchModeSmart, SearchModePhonetic}
+
+// Reports whether a name is one of the supported search modes
+func IsSearchMode(name string) bool {
+	for _, mode := range SearchModes {
+		if mode == name {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// The number of word moves tolerated by phrase matching
+	phraseSlop = 3
+	// The percentage of query words which must match in fuzzy matching
+	fuzzyMinimumMatch = 75
+)
+
+// The fields searched when a search does not name any, outside of the query mode
+var defaultSearchFields = []string{"lyrics"}
+
+// The field holding the phonetic encoding of the lyrics
+const phoneticField = "lyrics_phonetic"
+
+// A lyric search to be run by a TrackStore
+type TrackSearch struct {
+	// The text to search for, interpreted according to Mode
+	Query string
+	// One of SearchModes. Empty is treated as SearchModeQuery
+	Mode string
+	// The fields searched by the query, or by query clauses which do not name a field in the query mode. An empty
+	// slice searches every field in the query mode, and the lyrics otherwise
+	Fields []string
+	// Restricts the search to these Spotify track IDs. A nil slice searches every indexed track
+	TrackIDs []string
+	// Restrictions on track metadata, applied alongside the query
+	Filters TrackFilters
+	Limit   int
+	Offset  int
+}
+
+// The names of the supported TrackStore backends
+var TrackStoreKinds = []string{"elastic", "bleve"}
+
+// Opens a TrackStore of the given kind. 'location' is the Elasticsearch address for the elastic backend, or the
+// on-disk index path for the bleve backend
+func OpenTrackStore(kind, location string) (TrackStore, error) {
+	switch kind {
+	case "elastic":
+		elasticStore, err := NewElasticStore(location)
+		if err != nil {
+			return nil, err
+		}
+		return elasticStore, nil
+	case "bleve":
+		bleveStore, err := NewBleveStore(location)
+		if err != nil {
+			return nil, err
+		}
+		return bleveStore, nil
+	default:
+		return nil, fmt.Errorf("unknown track store %s", kind)
+	}
+}
+
+// Sets the TrackStore used for indexing and searching
+func UseTrackStore(trackStore TrackStore) {
+	store = trackStore
+}
+
+// Runs a lyric search against the configured TrackStore
+func SearchTracks(ctx context.Context, search TrackSearch) (SearchResults, error) {
+	return store.Search(ctx, search)
+}
+
+// The number of search results fetched at a time by SearchAllTracks
+const searchPageSize = 500
+
+// Runs a lyric search against the configured TrackStore page by page, returning the Spotify metadata of up to 'max'
+// matching tracks in order of relevance, along with the total number of matches. The search's own paging is ignored
+func SearchAllTracks(ctx context.Context, search TrackSearch, max int) ([]spotify.FullTrack, int, error) {
+	var tracks []spotify.FullTrack
+	total := 0
+	search.Limit = searchPageSize
+	for search.Offset = 0; search.Offset < max; search.Offset += search.Limit {
+		if search.Offset+search.Limit > max {
+			search.Limit = max - search.Offset
+		}
+		results, err := SearchTracks(ctx, search)
+		if err != nil {
+			return nil, 0, err
+		}
+		total = results.Total
+		for _, hit := range results.Results {
+			tracks = append(tracks, hit.Spotify)
+		}
+		if len(results.Results) < search.Limit || search.Offset+len(results.Results) >= results.Total {
+			break
+		}
+	}
+	return tracks, total, nil
+}
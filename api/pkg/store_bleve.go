@@ -0,0 +1,382 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/v2/analysis/tokenizer/whitespace"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// A TrackStore backed by an embedded Bleve full-text index on local disk, for running without Elasticsearch
+type BleveStore struct {
+	index bleve.Index
+}
+
+// Opens the Bleve index at the given path, creating it if it does not yet exist
+func NewBleveStore(path string) (*BleveStore, error) {
+	index, err := bleve.Open(path)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		log.Infof("creating bleve index at %s", path)
+		index, err = bleve.New(path, newBleveMapping())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open bleve index: %w", err)
+	}
+	log.Infof("opened bleve index at %s", path)
+	return &BleveStore{index: index}, nil
+}
+
+// Builds the mapping for new indices. Fields are mapped dynamically, except for the phonetic lyrics, whose codes must
+// be matched as written rather than lowercased and filtered for stop words, and the stanzas and synced lyrics, which
+// repeat the lyrics and are not searched
+func newBleveMapping() mapping.IndexMapping {
+	indexMapping := bleve.NewIndexMapping()
+	err := indexMapping.AddCustomAnalyzer("phonetic", map[string]interface{}{
+		"type":      custom.Name,
+		"tokenizer": whitespace.Name,
+	})
+	if err != nil {
+		log.Fatalf("could not define phonetic analyzer: %s", err.Error())
+	}
+	phoneticMapping := bleve.NewTextFieldMapping()
+	phoneticMapping.Analyzer = "phonetic"
+	indexMapping.DefaultMapping.AddFieldMappingsAt(phoneticField, phoneticMapping)
+	indexMapping.DefaultMapping.AddSubDocumentMapping("stanzas", bleve.NewDocumentDisabledMapping())
+	indexMapping.DefaultMapping.AddSubDocumentMapping("synced_lyrics", bleve.NewDocumentDisabledMapping())
+	return indexMapping
+}
+
+func (s *BleveStore) GetTrack(ctx context.Context, spotifyID string) (*VerseTrack, error) {
+	doc, err := s.index.GetInternal(bleveSourceKey(spotifyID))
+	if err != nil {
+		return nil, fmt.Errorf("could not query bleve for existing track: %w", err)
+	}
+	if doc == nil {
+		return nil, nil
+	}
+	track, err := s.getTrack(spotifyID)
+	if err != nil {
+		return nil, err
+	}
+	return &track, nil
+}
+
+func (s *BleveStore) PutTrack(ctx context.Context, track VerseTrack) error {
+	jsonDoc, err := json.Marshal(track)
+	if err != nil {
+		log.Fatalf("could not marshal doc for bleve: %s", err.Error())
+	}
+	// Index the JSON representation rather than the struct so that field names match the Elasticsearch documents
+	var fields map[string]interface{}
+	err = json.Unmarshal(jsonDoc, &fields)
+	if err != nil {
+		log.Fatalf("could not unmarshal doc for bleve: %s", err.Error())
+	}
+	id := track.Spotify.ID.String()
+	batch := s.index.NewBatch()
+	err = batch.Index(id, fields)
+	if err != nil {
+		return fmt.Errorf("could not index document in bleve: %w", err)
+	}
+	// Bleve does not keep document sources, so store the original alongside the index
+	batch.SetInternal(bleveSourceKey(id), jsonDoc)
+	err = s.index.Batch(batch)
+	if err != nil {
+		return fmt.Errorf("could not index document in bleve: %w", err)
+	}
+	return nil
+}
+
+func (s *BleveStore) Search(ctx context.Context, search TrackSearch) (SearchResults, error) {
+	textQuery, err := s.textQuery(search)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	searchQuery := textQuery
+	restrictions := bleveFilters(search.Filters)
+	if search.TrackIDs != nil {
+		restrictions = append(restrictions, bleve.NewDocIDQuery(search.TrackIDs))
+	}
+	if len(restrictions) > 0 {
+		searchQuery = bleve.NewConjunctionQuery(append(restrictions, textQuery)...)
+	}
+
+	req := bleve.NewSearchRequestOptions(searchQuery, search.Limit, search.Offset, false)
+	// Term locations are used to build lyric snippets
+	req.IncludeLocations = true
+	resp, err := s.index.SearchInContext(ctx, req)
+	if err != nil {
+		return SearchResults{}, fmt.Errorf("%w: %s", ErrInvalidQuery, err.Error())
+	}
+	log.Debugf("search for '%s' returned %d results", search.Query, resp.Total)
+
+	var results SearchResults
+	results.Total = int(resp.Total)
+	for _, hit := range resp.Hits {
+		track, err := s.getTrack(hit.ID)
+		if err != nil {
+			return SearchResults{}, err
+		}
+		var spans, phoneticSpans []MatchSpan
+		for _, locations := range hit.Locations["lyrics"] {
+			for _, location := range locations {
+				spans = append(spans, MatchSpan{Start: int(location.Start), End: int(location.End)})
+			}
+		}
+		for _, locations := range hit.Locations[phoneticField] {
+			for _, location := range locations {
+				phoneticSpans = append(phoneticSpans, MatchSpan{Start: int(location.Start), End: int(location.End)})
+			}
+		}
+		spans = append(spans, phoneticSpansToLyrics(track.Lyrics, phoneticSpans)...)
+		results.Results = append(results.Results, SearchHit{
+			VerseTrack: track,
+			Score:      hit.Score,
+			Snippets:   buildSnippets(track, spans),
+		})
+	}
+	return results, nil
+}
+
+// Pages through every indexed track in document ID order
+func (s *BleveStore) ForEachTrack(ctx context.Context, fn func(track VerseTrack) error) error {
+	var after []string
+	for {
+		req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 500, 0, false)
+		req.SortBy([]string{"_id"})
+		req.SearchAfter = after
+		resp, err := s.index.SearchInContext(ctx, req)
+		if err != nil {
+			return fmt.Errorf("could not list bleve tracks: %w", err)
+		}
+		if len(resp.Hits) == 0 {
+			return nil
+		}
+		for _, hit := range resp.Hits {
+			track, err := s.getTrack(hit.ID)
+			if err != nil {
+				return err
+			}
+			if err := fn(track); err != nil {
+				return err
+			}
+		}
+		after = []string{resp.Hits[len(resp.Hits)-1].ID}
+	}
+}
+
+func (s *BleveStore) Close() error {
+	return s.index.Close()
+}
+
+// Builds the scoring query for a search's text according to its mode
+func (s *BleveStore) textQuery(search TrackSearch) (query.Query, error) {
+	queryString := strings.TrimSpace(search.Query)
+	if queryString == "" || queryString == "*" {
+		return bleve.NewMatchAllQuery(), nil
+	}
+	if search.Mode == "" || search.Mode == SearchModeQuery {
+		if len(search.Fields) == 0 {
+			return parseBleveQueryString(queryString, "")
+		}
+		var fieldQueries []query.Query
+		for _, field := range search.Fields {
+			fieldQuery, err := parseBleveQueryString(queryString, field)
+			if err != nil {
+				return nil, err
+			}
+			fieldQueries = append(fieldQueries, fieldQuery)
+		}
+		return bleve.NewDisjunctionQuery(fieldQueries...), nil
+	}
+
+	fields := search.Fields
+	if len(fields) == 0 {
+		fields = defaultSearchFields
+	}
+	// Bleve phrase queries do not support slop, so the phrase mode instead tolerates a misspelt word within the phrase
+	phrase := func(fields []string, text string, fuzziness int, boost float64) query.Query {
+		var fieldQueries []query.Query
+		for _, field := range fields {
+			phraseQuery := bleve.NewMatchPhraseQuery(text)
+			phraseQuery.SetField(field)
+			phraseQuery.SetFuzziness(fuzziness)
+			phraseQuery.SetBoost(boost)
+			fieldQueries = append(fieldQueries, phraseQuery)
+		}
+		return bleve.NewDisjunctionQuery(fieldQueries...)
+	}
+	fuzzy := func(fields []string, text string) query.Query {
+		var fieldQueries []query.Query
+		for _, field := range fields {
+			// Analyze the query as the field is, so that words dropped by the analyzer do not count towards the minimum
+			indexMapping := s.index.Mapping()
+			analyzer := indexMapping.AnalyzerNamed(indexMapping.AnalyzerNameForPath(field))
+			if analyzer == nil {
+				continue
+			}
+			tokens := analyzer.Analyze([]byte(text))
+			if len(tokens) == 0 {
+				continue
+			}
+			var termQueries []query.Query
+			for _, token := range tokens {
+				term := string(token.Term)
+				// Fuzzy queries require some fuzziness, so short terms are matched exactly
+				if fuzziness := autoFuzziness(term); fuzziness > 0 {
+					termQuery := bleve.NewFuzzyQuery(term)
+					termQuery.SetField(field)
+					termQuery.SetFuzziness(fuzziness)
+					termQueries = append(termQueries, termQuery)
+				} else {
+					termQuery := bleve.NewTermQuery(term)
+					termQuery.SetField(field)
+					termQueries = append(termQueries, termQuery)
+				}
+			}
+			fieldQuery := bleve.NewDisjunctionQuery(termQueries...)
+			fieldQuery.SetMin(float64((len(tokens)*fuzzyMinimumMatch + 99) / 100))
+			fieldQueries = append(fieldQueries, fieldQuery)
+		}
+		return bleve.NewDisjunctionQuery(fieldQueries...)
+	}
+	smart := bleve.NewDisjunctionQuery(phrase(fields, queryString, 0, 10), phrase(fields, queryString, 1, 4), fuzzy(fields, queryString))
+	switch search.Mode {
+	case SearchModeExact:
+		return phrase(fields, queryString, 0, 1), nil
+	case SearchModePhrase:
+		return phrase(fields, queryString, 1, 1), nil
+	case SearchModeFuzzy:
+		return fuzzy(fields, queryString), nil
+	case SearchModePhonetic:
+		// Sound-alike matches rank below those on the words themselves
+		codes := phoneticQuery(queryString)
+		phoneticFields := []string{phoneticField}
+		return bleve.NewDisjunctionQuery(smart, phrase(phoneticFields, codes, 0, 2), fuzzy(phoneticFields, codes)), nil
+	default:
+		return smart, nil
+	}
+}
+
+// The edit distance tolerated for a word in fuzzy matching, following Elasticsearch's AUTO fuzziness
+func autoFuzziness(word string) int {
+	switch length := len([]rune(word)); {
+	case length <= 2:
+		return 0
+	case length <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Builds the queries restricting a search to tracks matching the given metadata filters
+func bleveFilters(filters TrackFilters) []query.Query {
+	var queries []query.Query
+	matchAll := func(field, text string) {
+		if text == "" {
+			return
+		}
+		match := bleve.NewMatchQuery(text)
+		match.SetField(field)
+		match.SetOperator(query.MatchQueryOperatorAnd)
+		queries = append(queries, match)
+	}
+	matchAll("spotify.artists.name", filters.Artist)
+	matchAll("spotify.album.name", filters.Album)
+
+	between := func(field string, min, max *int) {
+		if min == nil && max == nil {
+			return
+		}
+		var minValue, maxValue *float64
+		if min != nil {
+			minValue = &[]float64{float64(*min)}[0]
+		}
+		if max != nil {
+			maxValue = &[]float64{float64(*max)}[0]
+		}
+		inclusive := true
+		numeric := bleve.NewNumericRangeInclusiveQuery(minValue, maxValue, &inclusive, &inclusive)
+		numeric.SetField(field)
+		queries = append(queries, numeric)
+	}
+	between("year", filters.YearMin, filters.YearMax)
+	between("spotify.popularity", filters.PopularityMin, filters.PopularityMax)
+	between("spotify.duration_ms", filters.DurationMinMs, filters.DurationMaxMs)
+	between("provenance.scraper_version", filters.ScraperVersionMin, filters.ScraperVersionMax)
+	matchAll("provenance.provider", filters.Provider)
+	matchAll("provenance.status", filters.Status)
+	if filters.excludesInstrumentals() {
+		instrumental := bleve.NewBoolFieldQuery(true)
+		instrumental.SetField("instrumental")
+		excluded := bleve.NewBooleanQuery()
+		excluded.AddMustNot(instrumental)
+		queries = append(queries, excluded)
+	}
+	if filters.RetryDueBy != nil {
+		notFound := bleve.NewMatchQuery(LyricsNotFound)
+		notFound.SetField("provenance.status")
+		failed := bleve.NewMatchQuery(LyricsFailed)
+		failed.SetField("provenance.status")
+		inclusive := true
+		retryAt := bleve.NewDateRangeInclusiveQuery(time.Time{}, *filters.RetryDueBy, &inclusive, &inclusive)
+		retryAt.SetField("provenance.retry_at")
+		queries = append(queries, bleve.NewDisjunctionQuery(notFound, failed), retryAt)
+	}
+
+	if filters.ConfidenceMin != nil || filters.ConfidenceMax != nil {
+		inclusive := true
+		confidence := bleve.NewNumericRangeInclusiveQuery(filters.ConfidenceMin, filters.ConfidenceMax, &inclusive, &inclusive)
+		confidence.SetField("provenance.confidence")
+		queries = append(queries, confidence)
+	}
+	if filters.FetchedAfter != nil || filters.FetchedBefore != nil {
+		// Zero times leave either end of the range open
+		var after, before time.Time
+		if filters.FetchedAfter != nil {
+			after = *filters.FetchedAfter
+		}
+		if filters.FetchedBefore != nil {
+			before = *filters.FetchedBefore
+		}
+		inclusive, exclusive := true, false
+		fetchedAt := bleve.NewDateRangeInclusiveQuery(after, before, &inclusive, &exclusive)
+		fetchedAt.SetField("provenance.fetched_at")
+		queries = append(queries, fetchedAt)
+	}
+
+	if filters.Explicit != nil {
+		explicit := bleve.NewBoolFieldQuery(*filters.Explicit)
+		explicit.SetField("spotify.explicit")
+		queries = append(queries, explicit)
+	}
+	return queries
+}
+
+// Loads the stored source of an indexed track
+func (s *BleveStore) getTrack(spotifyID string) (VerseTrack, error) {
+	var track VerseTrack
+	doc, err := s.index.GetInternal(bleveSourceKey(spotifyID))
+	if err != nil {
+		return track, fmt.Errorf("could not load track %s from bleve: %w", spotifyID, err)
+	}
+	err = json.Unmarshal(doc, &track)
+	if err != nil {
+		return track, fmt.Errorf("bleve returned a non-JSON track source for %s: %w", spotifyID, err)
+	}
+	return track, nil
+}
+
+// The internal storage key under which a track's JSON source is kept
+func bleveSourceKey(spotifyID string) []byte {
+	return []byte("source/" + spotifyID)
+}
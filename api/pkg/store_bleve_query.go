@@ -0,0 +1,270 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"strconv"
+	"strings"
+)
+
+// The kinds of token in a Lucene-style query string
+const (
+	queryTokenTerm = iota
+	queryTokenOpen
+	queryTokenClose
+	// A field name immediately followed by an opening parenthesis, as in field:(a b)
+	queryTokenField
+	// A + or - prefix
+	queryTokenModifier
+	// A ^boost suffix after a closing parenthesis
+	queryTokenBoost
+)
+
+type queryToken struct {
+	kind  int
+	value string
+}
+
+// How a clause of a query string group must occur in matching documents
+const (
+	occurMust = iota
+	occurShould
+	occurMustNot
+)
+
+type queryClause struct {
+	occur int
+	query query.Query
+}
+
+// Parses a Lucene-style query string into a Bleve query, following Elasticsearch's query_string with
+// default_operator AND: clauses are required unless joined by OR, and parenthesised groups nest. Bleve's own query
+// string syntax has neither operators nor groups, so only the individual terms are left to it. Terms which do not name
+// a field are directed at 'defaultField' if it is set
+func parseBleveQueryString(queryString, defaultField string) (query.Query, error) {
+	tokens, err := tokenizeQueryString(queryString)
+	if err != nil {
+		return nil, err
+	}
+	parser := &bleveQueryParser{tokens: tokens}
+	return parser.parseGroup(defaultField, false)
+}
+
+type bleveQueryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *bleveQueryParser) next() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	p.pos++
+	return p.tokens[p.pos-1], true
+}
+
+// Parses clauses up to the end of the query string, or the closing parenthesis of a nested group, combining them as
+// Lucene's classic query parser does
+func (p *bleveQueryParser) parseGroup(field string, nested bool) (query.Query, error) {
+	var clauses []queryClause
+	for {
+		token, ok := p.next()
+		if !ok {
+			if nested {
+				return nil, fmt.Errorf("%w: missing closing parenthesis", ErrInvalidQuery)
+			}
+			break
+		}
+		if token.kind == queryTokenClose {
+			if !nested {
+				return nil, fmt.Errorf("%w: unexpected closing parenthesis", ErrInvalidQuery)
+			}
+			break
+		}
+
+		conjunction := ""
+		if token.kind == queryTokenTerm && (token.value == "AND" || token.value == "&&" || token.value == "OR" || token.value == "||") {
+			conjunction = token.value
+			if len(clauses) == 0 {
+				return nil, fmt.Errorf("%w: %s must follow a clause", ErrInvalidQuery, conjunction)
+			}
+			if token, ok = p.next(); !ok || token.kind == queryTokenClose {
+				return nil, fmt.Errorf("%w: %s must be followed by a clause", ErrInvalidQuery, conjunction)
+			}
+		}
+		or := conjunction == "OR" || conjunction == "||"
+
+		modifier := ""
+		if token.kind == queryTokenModifier || (token.kind == queryTokenTerm && token.value == "NOT") {
+			modifier = token.value
+			if token, ok = p.next(); !ok || token.kind == queryTokenClose {
+				return nil, fmt.Errorf("%w: %s must be followed by a clause", ErrInvalidQuery, modifier)
+			}
+		}
+
+		clause, err := p.parseClause(token, field)
+		if err != nil {
+			return nil, err
+		}
+
+		// As in Lucene, OR makes the preceding clause optional as well as the following one, and AND makes it required,
+		// unless either is excluded
+		if previous := len(clauses) - 1; conjunction != "" && clauses[previous].occur != occurMustNot {
+			if or {
+				clauses[previous].occur = occurShould
+			} else {
+				clauses[previous].occur = occurMust
+			}
+		}
+		occur := occurMust
+		switch {
+		case modifier == "-" || modifier == "NOT":
+			occur = occurMustNot
+		case or && modifier != "+":
+			occur = occurShould
+		}
+		clauses = append(clauses, queryClause{occur: occur, query: clause})
+	}
+
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("%w: empty query or group", ErrInvalidQuery)
+	}
+	if len(clauses) == 1 && clauses[0].occur != occurMustNot {
+		return clauses[0].query, nil
+	}
+	var must, should, mustNot []query.Query
+	for _, clause := range clauses {
+		switch clause.occur {
+		case occurMust:
+			must = append(must, clause.query)
+		case occurShould:
+			should = append(should, clause.query)
+		default:
+			mustNot = append(mustNot, clause.query)
+		}
+	}
+	// Query string mode skips clauses whose terms are all removed by analysis, as Lucene does
+	return query.NewBooleanQueryForQueryString(must, should, mustNot), nil
+}
+
+// Parses a single term, or a group which begins with the given token
+func (p *bleveQueryParser) parseClause(token queryToken, field string) (query.Query, error) {
+	switch token.kind {
+	case queryTokenTerm:
+		term := token.value
+		if field != "" && !clauseHasField(term) {
+			term = field + ":" + term
+		}
+		return bleve.NewQueryStringQuery(term), nil
+	case queryTokenField:
+		if open, ok := p.next(); !ok || open.kind != queryTokenOpen {
+			return nil, fmt.Errorf("%w: expected a group after %s:", ErrInvalidQuery, token.value)
+		}
+		return p.parseNestedGroup(token.value)
+	case queryTokenOpen:
+		return p.parseNestedGroup(field)
+	default:
+		return nil, fmt.Errorf("%w: unexpected %s", ErrInvalidQuery, token.value)
+	}
+}
+
+// Parses a parenthesised group, along with any boost following it
+func (p *bleveQueryParser) parseNestedGroup(field string) (query.Query, error) {
+	group, err := p.parseGroup(field, true)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == queryTokenBoost {
+		boost, err := strconv.ParseFloat(p.tokens[p.pos].value[1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid boost %s", ErrInvalidQuery, p.tokens[p.pos].value)
+		}
+		p.pos++
+		boosted, ok := group.(query.BoostableQuery)
+		if !ok {
+			return nil, fmt.Errorf("%w: group cannot be boosted", ErrInvalidQuery)
+		}
+		boosted.SetBoost(boost)
+	}
+	return group, nil
+}
+
+// Splits a query string into terms, parentheses and operators. Quoted phrases, ranges and escaped characters are kept
+// within their terms
+func tokenizeQueryString(queryString string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(queryString)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			i++
+			continue
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: queryTokenOpen, value: "("})
+			i++
+			continue
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: queryTokenClose, value: ")"})
+			i++
+			if i < len(runes) && runes[i] == '^' {
+				start := i
+				for i < len(runes) && !strings.ContainsRune(" \t\n()", runes[i]) {
+					i++
+				}
+				tokens = append(tokens, queryToken{kind: queryTokenBoost, value: string(runes[start:i])})
+			}
+			continue
+		case (r == '+' || r == '-') && i+1 < len(runes) && !strings.ContainsRune(" \t\n)", runes[i+1]):
+			tokens = append(tokens, queryToken{kind: queryTokenModifier, value: string(r)})
+			i++
+			continue
+		}
+
+		var term strings.Builder
+		inQuotes := false
+		rangeDepth := 0
+		for ; i < len(runes); i++ {
+			r := runes[i]
+			if r == '\\' && i+1 < len(runes) {
+				term.WriteRune(r)
+				term.WriteRune(runes[i+1])
+				i++
+				continue
+			}
+			if !inQuotes && rangeDepth == 0 && strings.ContainsRune(" \t\n()", r) {
+				break
+			}
+			switch {
+			case r == '"':
+				inQuotes = !inQuotes
+			case !inQuotes && (r == '[' || r == '{'):
+				rangeDepth++
+			case !inQuotes && (r == ']' || r == '}') && rangeDepth > 0:
+				rangeDepth--
+			}
+			term.WriteRune(r)
+		}
+		if inQuotes {
+			return nil, fmt.Errorf("%w: unterminated quoted phrase", ErrInvalidQuery)
+		}
+		if rangeDepth > 0 {
+			return nil, fmt.Errorf("%w: unterminated range", ErrInvalidQuery)
+		}
+		value := term.String()
+		if strings.HasSuffix(value, ":") && !strings.HasSuffix(value, "\\:") && i < len(runes) && runes[i] == '(' {
+			tokens = append(tokens, queryToken{kind: queryTokenField, value: strings.TrimSuffix(value, ":")})
+			continue
+		}
+		tokens = append(tokens, queryToken{kind: queryTokenTerm, value: value})
+	}
+	return tokens, nil
+}
+
+// Reports whether a query string clause names the field it applies to, as in field:value
+func clauseHasField(clause string) bool {
+	colon := strings.Index(clause, ":")
+	quote := strings.Index(clause, "\"")
+	return colon > 0 && (quote < 0 || colon < quote)
+}
@@ -0,0 +1,499 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	// Delimit highlighted matches in Elasticsearch responses. Control characters are used as they cannot occur in lyrics
+	highlightPreTag  = "\x01"
+	highlightPostTag = "\x02"
+)
+
+// A result from an Elasticsearch query
+type ElasticSearchResult struct {
+	Took     int  `json:"took"`
+	TimedOut bool `json:"timed_out"`
+	Shards   struct {
+		Total      int `json:"total"`
+		Successful int `json:"successful"`
+		Skipped    int `json:"skipped"`
+		Failed     int `json:"failed"`
+	} `json:"_shards"`
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		MaxScore float64 `json:"max_score"`
+		Hits     []struct {
+			Index     string              `json:"_index"`
+			Type      string              `json:"_type"`
+			ID        string              `json:"_id"`
+			Score     float64             `json:"_score"`
+			Source    VerseTrack          `json:"_source"`
+			Highlight map[string][]string `json:"highlight"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// A TrackStore backed by an Elasticsearch instance, reading and writing tracks through the "tracks" alias
+type ElasticStore struct {
+	es *elasticsearch.Client
+}
+
+// Connects to the Elasticsearch instance at the given address
+func NewElasticStore(esAddr string) (*ElasticStore, error) {
+	cfg := elasticsearch.Config{
+		Addresses: []string{
+			esAddr,
+		},
+	}
+	es, err := elasticsearch.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize elasticsearch connection: %w", err)
+	}
+	//noinspection GoNilness
+	_, err = es.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to elasticsearch: %w", err)
+	}
+	log.Infof("connected to elasticsearch")
+	elasticStore := &ElasticStore{es: es}
+	if err := elasticStore.installIndexTemplate(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := elasticStore.ensureTracksIndex(context.Background()); err != nil {
+		return nil, err
+	}
+	return elasticStore, nil
+}
+
+// Look up an indexed track by its Spotify ID
+func (s *ElasticStore) GetTrack(ctx context.Context, spotifyID string) (*VerseTrack, error) {
+	queryObj := map[string]interface{}{
+		"query": map[string]interface{}{
+			"ids": map[string]interface{}{
+				"values": []string{spotifyID},
+			},
+		},
+	}
+	respJson, err := s.search(ctx, queryObj, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not query elastic for existing track: %w", err)
+	}
+	if len(respJson.Hits.Hits) == 0 {
+		return nil, nil
+	}
+	return &respJson.Hits.Hits[0].Source, nil
+}
+
+func (s *ElasticStore) PutTrack(ctx context.Context, track VerseTrack) error {
+	jsonDoc, err := json.Marshal(track)
+	if err != nil {
+		log.Fatalf("could not marshal doc for elasticsearch: %s", err.Error())
+	}
+	req := esapi.IndexRequest{
+		DocumentID: track.Spotify.ID.String(),
+		Index:      tracksAlias,
+		Body:       bytes.NewReader(jsonDoc),
+		Refresh:    "wait_for",
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	resp, err := req.Do(ctx, s.es)
+	if err != nil {
+		return fmt.Errorf("could not index document in elasticsearch: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.IsError() {
+		return fmt.Errorf("could not index document in elasticsearch: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *ElasticStore) Search(ctx context.Context, search TrackSearch) (SearchResults, error) {
+	must := []interface{}{elasticTextQuery(search)}
+	if search.TrackIDs != nil {
+		must = append([]interface{}{
+			map[string]interface{}{
+				"ids": map[string]interface{}{
+					"values": search.TrackIDs,
+				},
+			},
+		}, must...)
+	}
+	boolQuery := map[string]interface{}{
+		"must": must,
+	}
+	if filter := elasticFilters(search.Filters); len(filter) > 0 {
+		boolQuery["filter"] = filter
+	}
+	queryJson := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": boolQuery,
+		},
+		"highlight": map[string]interface{}{
+			// Highlight the lyrics in full, so that match offsets can be mapped back to lines
+			"number_of_fragments": 0,
+			"pre_tags":            []string{highlightPreTag},
+			"post_tags":           []string{highlightPostTag},
+			"fields": map[string]interface{}{
+				"lyrics":      map[string]interface{}{},
+				phoneticField: map[string]interface{}{},
+			},
+		},
+	}
+	respJson, err := s.search(ctx, queryJson, &search.Limit, &search.Offset)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	log.Debugf("search for '%s' returned %d results", search.Query, respJson.Hits.Total.Value)
+
+	var results SearchResults
+	results.Total = respJson.Hits.Total.Value
+	for _, hit := range respJson.Hits.Hits {
+		searchHit := SearchHit{VerseTrack: hit.Source, Score: hit.Score}
+		var spans []MatchSpan
+		if highlighted := hit.Highlight["lyrics"]; len(highlighted) > 0 {
+			spans = elasticHighlightSpans(highlighted[0])
+		}
+		if highlighted := hit.Highlight[phoneticField]; len(highlighted) > 0 {
+			spans = append(spans, phoneticSpansToLyrics(hit.Source.Lyrics, elasticHighlightSpans(highlighted[0]))...)
+		}
+		searchHit.Snippets = buildSnippets(hit.Source, spans)
+		results.Results = append(results.Results, searchHit)
+	}
+	return results, nil
+}
+
+// Pages through every document in the tracks index with the scroll API
+func (s *ElasticStore) ForEachTrack(ctx context.Context, fn func(track VerseTrack) error) error {
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+		"sort":  []string{"_doc"},
+	})
+	if err != nil {
+		log.Fatalf("could not marshal query: %s", err.Error())
+	}
+	var req esapi.Request = esapi.SearchRequest{
+		Index:  []string{tracksAlias},
+		Body:   bytes.NewReader(query),
+		Size:   &[]int{500}[0],
+		Scroll: time.Minute,
+	}
+	var scrollID string
+	defer func() {
+		if scrollID != "" {
+			clearReq := esapi.ClearScrollRequest{ScrollID: []string{scrollID}}
+			_, _ = s.perform(context.Background(), clearReq, "clear scroll")
+		}
+	}()
+	for {
+		respBytes, err := s.perform(ctx, req, "scroll tracks")
+		if err != nil {
+			return err
+		}
+		var respJson struct {
+			ScrollID string `json:"_scroll_id"`
+			ElasticSearchResult
+		}
+		if err := json.Unmarshal(respBytes, &respJson); err != nil {
+			return fmt.Errorf("elastic returned a non-JSON search result: %w", err)
+		}
+		scrollID = respJson.ScrollID
+		if len(respJson.Hits.Hits) == 0 {
+			return nil
+		}
+		for _, hit := range respJson.Hits.Hits {
+			if err := fn(hit.Source); err != nil {
+				return err
+			}
+		}
+		req = esapi.ScrollRequest{ScrollID: scrollID, Scroll: time.Minute}
+	}
+}
+
+// Builds the scoring query for a search's text according to its mode
+func elasticTextQuery(search TrackSearch) map[string]interface{} {
+	if queryString := strings.TrimSpace(search.Query); queryString == "" || queryString == "*" {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	if search.Mode == "" || search.Mode == SearchModeQuery {
+		queryString := map[string]interface{}{
+			"query":            search.Query,
+			"analyze_wildcard": true,
+			"default_operator": "AND",
+		}
+		if len(search.Fields) > 0 {
+			queryString["fields"] = search.Fields
+		}
+		return map[string]interface{}{"query_string": queryString}
+	}
+
+	fields := search.Fields
+	if len(fields) == 0 {
+		fields = defaultSearchFields
+	}
+	phrase := func(slop, boost int) map[string]interface{} {
+		return map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":  search.Query,
+				"fields": fields,
+				"type":   "phrase",
+				"slop":   slop,
+				"boost":  boost,
+			},
+		}
+	}
+	fuzzy := map[string]interface{}{
+		"multi_match": map[string]interface{}{
+			"query":                search.Query,
+			"fields":               fields,
+			"fuzziness":            "AUTO",
+			"minimum_should_match": fmt.Sprintf("%d%%", fuzzyMinimumMatch),
+		},
+	}
+	// Every track matching fuzzily is a result, and those also matching as a phrase, or better still exactly, rank
+	// above the rest
+	smart := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               []interface{}{phrase(0, 10), phrase(phraseSlop, 4), fuzzy},
+			"minimum_should_match": 1,
+		},
+	}
+	switch search.Mode {
+	case SearchModeExact:
+		return phrase(0, 1)
+	case SearchModePhrase:
+		return phrase(phraseSlop, 1)
+	case SearchModeFuzzy:
+		return fuzzy
+	case SearchModePhonetic:
+		// Sound-alike matches rank below those on the words themselves
+		codes := phoneticQuery(search.Query)
+		return map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should": []interface{}{
+					smart,
+					map[string]interface{}{
+						"match_phrase": map[string]interface{}{
+							phoneticField: map[string]interface{}{"query": codes, "slop": phraseSlop, "boost": 2},
+						},
+					},
+					map[string]interface{}{
+						"match": map[string]interface{}{
+							phoneticField: map[string]interface{}{
+								"query":                codes,
+								"fuzziness":            "AUTO",
+								"minimum_should_match": fmt.Sprintf("%d%%", fuzzyMinimumMatch),
+							},
+						},
+					},
+				},
+				"minimum_should_match": 1,
+			},
+		}
+	default:
+		return smart
+	}
+}
+
+// Finds the matched spans in text highlighted by Elasticsearch, as offsets into the original text
+func elasticHighlightSpans(highlighted string) []MatchSpan {
+	var spans []MatchSpan
+	offset := 0
+	for {
+		start := strings.Index(highlighted, highlightPreTag)
+		if start < 0 {
+			return spans
+		}
+		end := strings.Index(highlighted[start:], highlightPostTag)
+		if end < 0 {
+			return spans
+		}
+		matched := len(highlighted[start+len(highlightPreTag) : start+end])
+		spans = append(spans, MatchSpan{Start: offset + start, End: offset + start + matched})
+		offset += start + matched
+		highlighted = highlighted[start+end+len(highlightPostTag):]
+	}
+}
+
+func (s *ElasticStore) Close() error {
+	return nil
+}
+
+// Builds the non-scoring filter clauses restricting a search to tracks matching the given metadata filters
+func elasticFilters(filters TrackFilters) []interface{} {
+	var clauses []interface{}
+	matchAll := func(field, text string) {
+		if text == "" {
+			return
+		}
+		clauses = append(clauses, map[string]interface{}{
+			"match": map[string]interface{}{
+				field: map[string]interface{}{"query": text, "operator": "and"},
+			},
+		})
+	}
+	matchAll("spotify.artists.name", filters.Artist)
+	matchAll("spotify.album.name", filters.Album)
+
+	between := func(field string, min, max *int) {
+		bounds := map[string]interface{}{}
+		if min != nil {
+			bounds["gte"] = *min
+		}
+		if max != nil {
+			bounds["lte"] = *max
+		}
+		if len(bounds) > 0 {
+			clauses = append(clauses, map[string]interface{}{
+				"range": map[string]interface{}{field: bounds},
+			})
+		}
+	}
+	between("year", filters.YearMin, filters.YearMax)
+	between("spotify.popularity", filters.PopularityMin, filters.PopularityMax)
+	between("spotify.duration_ms", filters.DurationMinMs, filters.DurationMaxMs)
+	between("provenance.scraper_version", filters.ScraperVersionMin, filters.ScraperVersionMax)
+
+	confidence := map[string]interface{}{}
+	if filters.ConfidenceMin != nil {
+		confidence["gte"] = *filters.ConfidenceMin
+	}
+	if filters.ConfidenceMax != nil {
+		confidence["lte"] = *filters.ConfidenceMax
+	}
+	fetchedAt := map[string]interface{}{}
+	if filters.FetchedAfter != nil {
+		fetchedAt["gte"] = filters.FetchedAfter.Format(time.RFC3339)
+	}
+	if filters.FetchedBefore != nil {
+		fetchedAt["lt"] = filters.FetchedBefore.Format(time.RFC3339)
+	}
+	for field, bounds := range map[string]map[string]interface{}{"provenance.confidence": confidence, "provenance.fetched_at": fetchedAt} {
+		if len(bounds) > 0 {
+			clauses = append(clauses, map[string]interface{}{
+				"range": map[string]interface{}{field: bounds},
+			})
+		}
+	}
+
+	if filters.excludesInstrumentals() {
+		clauses = append(clauses, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must_not": map[string]interface{}{"term": map[string]interface{}{"instrumental": true}},
+			},
+		})
+	}
+	if filters.Status != "" {
+		clauses = append(clauses, map[string]interface{}{
+			"term": map[string]interface{}{"provenance.status": filters.Status},
+		})
+	}
+	if filters.RetryDueBy != nil {
+		clauses = append(clauses,
+			map[string]interface{}{
+				"terms": map[string]interface{}{"provenance.status": []string{LyricsNotFound, LyricsFailed}},
+			},
+			map[string]interface{}{
+				"range": map[string]interface{}{
+					"provenance.retry_at": map[string]interface{}{"lte": filters.RetryDueBy.Format(time.RFC3339)},
+				},
+			},
+		)
+	}
+	if filters.Provider != "" {
+		clauses = append(clauses, map[string]interface{}{
+			"term": map[string]interface{}{"provenance.provider": filters.Provider},
+		})
+	}
+
+	if filters.Explicit != nil {
+		clauses = append(clauses, map[string]interface{}{
+			"term": map[string]interface{}{"spotify.explicit": *filters.Explicit},
+		})
+	}
+	return clauses
+}
+
+// Runs a search request against the tracks index. A missing index yields an empty result
+func (s *ElasticStore) search(ctx context.Context, queryObj map[string]interface{}, size, from *int) (ElasticSearchResult, error) {
+	query, err := json.Marshal(queryObj)
+	if err != nil {
+		log.Fatalf("could not marshal query: %s", err.Error())
+	}
+	log.Debugf("raw query: %s", query)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	req := esapi.SearchRequest{
+		Index:       []string{tracksAlias},
+		Body:        bytes.NewReader(query),
+		TrackScores: &[]bool{true}[0],
+		Size:        size,
+		From:        from,
+	}
+	resp, err := req.Do(ctx, s.es)
+	if err != nil {
+		return ElasticSearchResult{}, fmt.Errorf("could not search elasticsearch: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ElasticSearchResult{}, fmt.Errorf("could not read elasticsearch response: %w", err)
+	}
+	var respJson ElasticSearchResult
+	if resp.StatusCode == 404 {
+		return respJson, nil
+	}
+	if resp.IsError() {
+		if resp.StatusCode == 400 && elasticQueryRejected(respBytes) {
+			return respJson, fmt.Errorf("%w: %s", ErrInvalidQuery, string(respBytes))
+		}
+		return respJson, fmt.Errorf("could not search elasticsearch: status %d (%s)", resp.StatusCode, string(respBytes))
+	}
+	err = json.Unmarshal(respBytes, &respJson)
+	if err != nil {
+		return respJson, fmt.Errorf("elastic returned a non-JSON search result: %w", err)
+	}
+	return respJson, nil
+}
+
+// The types of Elasticsearch error given for a query string which could not be parsed or run
+var elasticQueryErrorTypes = map[string]bool{
+	"query_shard_exception":                true,
+	"parse_exception":                      true,
+	"too_complex_to_determinize_exception": true,
+}
+
+// Reports whether an Elasticsearch error response rejects the search's query itself, rather than another part of the
+// request such as paging beyond the result window
+func elasticQueryRejected(respBytes []byte) bool {
+	var errResp struct {
+		Error struct {
+			RootCause []struct {
+				Type string `json:"type"`
+			} `json:"root_cause"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(respBytes, &errResp); err != nil {
+		return false
+	}
+	for _, cause := range errResp.Error.RootCause {
+		if elasticQueryErrorTypes[cause.Type] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"time"
+)
+
+// The alias through which tracks are read and written. Before versioned indices it was the name of the index itself
+const tracksAlias = "tracks"
+
+// Returned by ElasticStore.Migrate when the tracks alias already points at the current index version
+var ErrAlreadyMigrated = errors.New("tracks index is already at the current version")
+
+// Returned by ElasticStore.CheckIndexVersion when the tracks alias points at an index with an older layout
+var ErrIndexOutdated = errors.New("tracks index has an outdated layout")
+
+// Fills in fields added since a document was indexed, so that migrated tracks can be filtered like new ones
+const migrateScript = `
+if (ctx._source.year == null && ctx._source.spotify?.album?.release_date != null
+    && ctx._source.spotify.album.release_date.length() >= 4) {
+  ctx._source.year = Integer.parseInt(ctx._source.spotify.album.release_date.substring(0, 4));
+}
+if (ctx._source.provenance == null) {
+  ctx._source.provenance = ['confidence': 0, 'scraper_version': 0];
+}
+if (ctx._source.provenance.status == null) {
+  if (ctx._source.lyrics == null || ctx._source.lyrics.isEmpty()) {
+    ctx._source.provenance.status = 'not_found';
+    ctx._source.provenance.retry_at = '1970-01-01T00:00:00Z';
+  } else {
+    ctx._source.provenance.status = 'found';
+  }
+}`
+
+// The name of the tracks index holding the given layout version
+func tracksIndexName(version int) string {
+	return fmt.Sprintf("%s_v%d", tracksAlias, version)
+}
+
+// Creates the current tracks index behind the tracks alias if there is no tracks index at all. A tracks index which
+// predates the alias is left in place, to be migrated
+func (s *ElasticStore) ensureTracksIndex(ctx context.Context) error {
+	current, _, err := s.resolveTracksAlias(ctx)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		log.Infof("creating elasticsearch index %s", tracksIndexName(tracksIndexVersion))
+		return s.createTracksIndex(ctx, tracksIndexName(tracksIndexVersion), true)
+	}
+	return nil
+}
+
+// Returns an error wrapping ErrIndexOutdated if the tracks alias points at an index with an older layout than the
+// current one. Fields added since are unmapped in such an index, so filters on them would silently match nothing
+func (s *ElasticStore) CheckIndexVersion(ctx context.Context) error {
+	current, isAlias, err := s.resolveTracksAlias(ctx)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return nil
+	}
+	if !isAlias {
+		return fmt.Errorf("%w: index %s predates versioned indices - run 'versefind migrate' to upgrade it", ErrIndexOutdated, tracksAlias)
+	}
+	for _, index := range current {
+		var version int
+		if _, err := fmt.Sscanf(index, tracksAlias+"_v%d", &version); err != nil {
+			return fmt.Errorf("alias %s points at unrecognised index %s", tracksAlias, index)
+		}
+		if version < tracksIndexVersion {
+			return fmt.Errorf("%w: alias %s points at %s - run 'versefind migrate' to upgrade to %s", ErrIndexOutdated, tracksAlias, index, tracksIndexName(tracksIndexVersion))
+		}
+		if version > tracksIndexVersion {
+			log.Warnf("elasticsearch alias %s points at %s, which is newer than this version of versefind expects", tracksAlias, index)
+		}
+	}
+	return nil
+}
+
+// How far before a migration's copy begins a track must have been fetched to be copied again once writes are blocked,
+// allowing for clock differences between this host and those running servers
+const migrateClockSkew = time.Minute
+
+// Copies every track into a new index with the current layout, then atomically switches the tracks alias to it. Writes
+// to the old index are blocked once the copy completes, while the tracks fetched during the copy are copied again and
+// the alias is switched, so none are lost; tracks which fail to be stored in that time are looked up again when next
+// indexed. The old index is left read-only, or removed if 'deleteOld' is set or it predates the alias. 'progress' is
+// called as each step begins
+func (s *ElasticStore) Migrate(ctx context.Context, deleteOld bool, progress func(step string)) error {
+	current, isAlias, err := s.resolveTracksAlias(ctx)
+	if err != nil {
+		return err
+	}
+	target := tracksIndexName(tracksIndexVersion)
+	if current == nil {
+		progress(fmt.Sprintf("creating %s", target))
+		return s.createTracksIndex(ctx, target, true)
+	}
+	if len(current) != 1 {
+		return fmt.Errorf("alias %s points at several indices (%v) - resolve this by hand", tracksAlias, current)
+	}
+	source := current[0]
+	if source == target {
+		return ErrAlreadyMigrated
+	}
+
+	progress(fmt.Sprintf("creating %s", target))
+	if err := s.createTracksIndex(ctx, target, false); err != nil {
+		return err
+	}
+	copyStart := time.Now().Add(-migrateClockSkew)
+	progress(fmt.Sprintf("copying tracks from %s to %s", source, target))
+	copied, err := s.reindex(ctx, source, target, nil)
+	if err != nil {
+		return err
+	}
+	log.Infof("copied %d tracks to %s", copied, target)
+
+	progress(fmt.Sprintf("blocking writes to %s", source))
+	if err := s.setWriteBlock(ctx, source, true); err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			if unblockErr := s.setWriteBlock(context.Background(), source, false); unblockErr != nil {
+				log.Errorf("could not unblock writes to %s after a failed migration: %s", source, unblockErr.Error())
+			}
+		}
+	}()
+	// Every track stored since provenance was recorded has a fetch time, so only those fetched during the copy, and any
+	// stored by older versions, need copying again
+	progress(fmt.Sprintf("copying tracks written to %s during the copy", source))
+	changed := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should": []interface{}{
+				map[string]interface{}{
+					"range": map[string]interface{}{
+						"provenance.fetched_at": map[string]interface{}{"gte": copyStart.UTC().Format(time.RFC3339)},
+					},
+				},
+				map[string]interface{}{
+					"bool": map[string]interface{}{
+						"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": "provenance.fetched_at"}},
+					},
+				},
+			},
+		},
+	}
+	copied, err = s.reindex(ctx, source, target, changed)
+	if err != nil {
+		return err
+	}
+	log.Infof("copied %d late tracks to %s", copied, target)
+
+	progress(fmt.Sprintf("switching %s to %s", tracksAlias, target))
+	var actions []interface{}
+	if isAlias {
+		actions = append(actions, map[string]interface{}{
+			"remove": map[string]interface{}{"index": source, "alias": tracksAlias},
+		})
+	} else {
+		// A concrete index cannot share its name with the alias, so it is removed in the same atomic step
+		actions = append(actions, map[string]interface{}{
+			"remove_index": map[string]interface{}{"index": source},
+		})
+	}
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]interface{}{"index": target, "alias": tracksAlias},
+	})
+	if err := s.updateAliases(ctx, actions); err != nil {
+		return err
+	}
+	swapped = true
+	if isAlias && deleteOld {
+		progress(fmt.Sprintf("deleting %s", source))
+		req := esapi.IndicesDeleteRequest{Index: []string{source}}
+		if _, err := s.perform(ctx, req, "delete old index"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finds the indices behind the tracks alias. If tracks is a concrete index rather than an alias, it is returned with
+// 'isAlias' false. If there is neither, 'indices' is nil
+func (s *ElasticStore) resolveTracksAlias(ctx context.Context) (indices []string, isAlias bool, err error) {
+	req := esapi.IndicesGetAliasRequest{Name: []string{tracksAlias}}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	resp, err := req.Do(ctx, s.es)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not look up tracks alias: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == 404 {
+		exists := esapi.IndicesExistsRequest{Index: []string{tracksAlias}}
+		existsResp, err := exists.Do(ctx, s.es)
+		if err != nil {
+			return nil, false, fmt.Errorf("could not look up tracks index: %w", err)
+		}
+		_ = existsResp.Body.Close()
+		if existsResp.StatusCode == 404 {
+			return nil, false, nil
+		}
+		return []string{tracksAlias}, false, nil
+	}
+	if resp.IsError() {
+		return nil, false, fmt.Errorf("could not look up tracks alias: status %d", resp.StatusCode)
+	}
+	var aliases map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&aliases); err != nil {
+		return nil, false, fmt.Errorf("elastic returned a non-JSON alias list: %w", err)
+	}
+	for index := range aliases {
+		indices = append(indices, index)
+	}
+	return indices, true, nil
+}
+
+// Creates a tracks index, to which the tracks index template applies, optionally already behind the tracks alias
+func (s *ElasticStore) createTracksIndex(ctx context.Context, name string, withAlias bool) error {
+	body := map[string]interface{}{}
+	if withAlias {
+		body["aliases"] = map[string]interface{}{tracksAlias: map[string]interface{}{}}
+	}
+	bodyJson, err := json.Marshal(body)
+	if err != nil {
+		log.Fatalf("could not marshal index creation request: %s", err.Error())
+	}
+	req := esapi.IndicesCreateRequest{Index: name, Body: bytes.NewReader(bodyJson)}
+	_, err = s.perform(ctx, req, "create index "+name)
+	return err
+}
+
+// Copies the tracks in one index to another, replacing any already in the destination. If 'query' is given, only the
+// tracks matching it are copied. Returns the number of tracks copied
+func (s *ElasticStore) reindex(ctx context.Context, source, dest string, query map[string]interface{}) (int, error) {
+	sourceObj := map[string]interface{}{"index": source}
+	if query != nil {
+		sourceObj["query"] = query
+	}
+	bodyJson, err := json.Marshal(map[string]interface{}{
+		"source": sourceObj,
+		"dest":   map[string]interface{}{"index": dest, "op_type": "index"},
+		"script": map[string]interface{}{"source": migrateScript, "lang": "painless"},
+	})
+	if err != nil {
+		log.Fatalf("could not marshal reindex request: %s", err.Error())
+	}
+	req := esapi.ReindexRequest{
+		Body:              bytes.NewReader(bodyJson),
+		Refresh:           &[]bool{true}[0],
+		WaitForCompletion: &[]bool{true}[0],
+	}
+	respBytes, err := s.perform(ctx, req, "reindex")
+	if err != nil {
+		return 0, err
+	}
+	var respJson struct {
+		Created  int           `json:"created"`
+		Updated  int           `json:"updated"`
+		Failures []interface{} `json:"failures"`
+	}
+	if err := json.Unmarshal(respBytes, &respJson); err != nil {
+		return 0, fmt.Errorf("elastic returned a non-JSON reindex result: %w", err)
+	}
+	copied := respJson.Created + respJson.Updated
+	if len(respJson.Failures) > 0 {
+		return copied, fmt.Errorf("could not reindex %d tracks: %v", len(respJson.Failures), respJson.Failures[0])
+	}
+	return copied, nil
+}
+
+// Blocks or unblocks writes to an index
+func (s *ElasticStore) setWriteBlock(ctx context.Context, index string, blocked bool) error {
+	bodyJson, err := json.Marshal(map[string]interface{}{
+		"index": map[string]interface{}{"blocks": map[string]interface{}{"write": blocked}},
+	})
+	if err != nil {
+		log.Fatalf("could not marshal index settings: %s", err.Error())
+	}
+	req := esapi.IndicesPutSettingsRequest{Index: []string{index}, Body: bytes.NewReader(bodyJson)}
+	_, err = s.perform(ctx, req, "set write block on "+index)
+	return err
+}
+
+// Applies a list of alias actions in a single atomic step
+func (s *ElasticStore) updateAliases(ctx context.Context, actions []interface{}) error {
+	bodyJson, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		log.Fatalf("could not marshal alias update: %s", err.Error())
+	}
+	req := esapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(bodyJson)}
+	_, err = s.perform(ctx, req, "update aliases")
+	return err
+}
+
+// Runs an administrative request, returning the response body or an error describing 'action' if it failed
+func (s *ElasticStore) perform(ctx context.Context, req esapi.Request, action string) ([]byte, error) {
+	resp, err := req.Do(ctx, s.es)
+	if err != nil {
+		return nil, fmt.Errorf("could not %s: %w", action, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read elasticsearch response: %w", err)
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("could not %s: status %d (%s)", action, resp.StatusCode, string(respBytes))
+	}
+	return respBytes, nil
+}
@@ -0,0 +1,177 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"time"
+)
+
+// The name of the index template applied to every versefind tracks index
+const tracksTemplateName = "versefind-tracks"
+
+// The version of the tracks index layout, bumped whenever the template changes. Version 1 was the index created
+// implicitly, without a template, before versioned indices were introduced
+const tracksIndexVersion = 7
+
+// Colloquial contractions and their expansions, matched either way round at search time. Apostrophes are stripped
+// before these are applied, so "don't" is written "dont". Contractions which are words in their own right once
+// apostrophes are stripped, such as 'cause, 'em and ya, are left out so that they do not match unrelated lyrics
+var lyricContractions = []string{
+	"gonna, going to",
+	"wanna, want to",
+	"gotta, got to",
+	"hafta, have to",
+	"kinda, kind of",
+	"outta, out of",
+	"lotta, lot of",
+	"gimme, give me",
+	"lemme, let me",
+	"dunno, dont know",
+	"aint, is not, are not",
+	"til, till, until",
+	"cmon, come on",
+	"yall, you all",
+}
+
+// The settings and mappings for tracks indices. Lyrics are analyzed so that typographic apostrophes, contractions,
+// accents and word endings do not prevent a match. Only the Spotify fields useful for searching and filtering are
+// indexed; the rest of the track is kept in the document source for display
+func tracksIndexTemplate() map[string]interface{} {
+	textWithKeyword := map[string]interface{}{
+		"type": "text",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+		},
+	}
+	keyword := map[string]interface{}{"type": "keyword"}
+	integer := map[string]interface{}{"type": "integer"}
+	lyrics := map[string]interface{}{"type": "text", "analyzer": "lyrics", "search_analyzer": "lyrics_search"}
+
+	return map[string]interface{}{
+		"index_patterns": []string{tracksAlias + "_*"},
+		"version":        tracksIndexVersion,
+		"settings": map[string]interface{}{
+			"analysis": map[string]interface{}{
+				"char_filter": map[string]interface{}{
+					// Typographic apostrophes and backticks are written as plain apostrophes...
+					"lyric_apostrophes": map[string]interface{}{
+						"type":     "mapping",
+						"mappings": []string{"’ => '", "‘ => '", "` => '"},
+					},
+					// ...and then dropped, so that "don't", "dont" and "don’t" all match, as do "goin'" and "goin"
+					"lyric_strip_apostrophes": map[string]interface{}{
+						"type":        "pattern_replace",
+						"pattern":     "'",
+						"replacement": "",
+					},
+				},
+				"filter": map[string]interface{}{
+					"lyric_contractions": map[string]interface{}{
+						"type":     "synonym_graph",
+						"synonyms": lyricContractions,
+					},
+					"lyric_stemmer": map[string]interface{}{
+						"type":     "stemmer",
+						"language": "english",
+					},
+				},
+				"analyzer": map[string]interface{}{
+					"lyrics": map[string]interface{}{
+						"type":        "custom",
+						"char_filter": []string{"lyric_apostrophes", "lyric_strip_apostrophes"},
+						"tokenizer":   "standard",
+						"filter":      []string{"lowercase", "asciifolding", "lyric_stemmer"},
+					},
+					// Multi-word synonyms can only be expanded at search time
+					"lyrics_search": map[string]interface{}{
+						"type":        "custom",
+						"char_filter": []string{"lyric_apostrophes", "lyric_strip_apostrophes"},
+						"tokenizer":   "standard",
+						"filter":      []string{"lowercase", "asciifolding", "lyric_contractions", "lyric_stemmer"},
+					},
+				},
+			},
+		},
+		"mappings": map[string]interface{}{
+			"dynamic": false,
+			"properties": map[string]interface{}{
+				"lyrics": lyrics,
+				// Metaphone codes are matched as written
+				phoneticField:  map[string]interface{}{"type": "text", "analyzer": "whitespace"},
+				"year":         integer,
+				"instrumental": map[string]interface{}{"type": "boolean"},
+				"provenance": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"provider":        keyword,
+						"url":             keyword,
+						"fetched_at":      map[string]interface{}{"type": "date"},
+						"confidence":      map[string]interface{}{"type": "float"},
+						"scraper_version": integer,
+						"status":          keyword,
+						"attempts":        integer,
+						"retry_at":        map[string]interface{}{"type": "date"},
+					},
+				},
+				"spotify": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"id":          keyword,
+						"uri":         keyword,
+						"name":        textWithKeyword,
+						"popularity":  integer,
+						"duration_ms": integer,
+						"explicit":    map[string]interface{}{"type": "boolean"},
+						"artists": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"id":   keyword,
+								"name": textWithKeyword,
+							},
+						},
+						"album": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"id":           keyword,
+								"name":         textWithKeyword,
+								"release_date": keyword,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// Installs or updates the tracks index template. The template only applies to indices created afterwards, so existing
+// indices take on changes by being migrated
+func (s *ElasticStore) installIndexTemplate(ctx context.Context) error {
+	body, err := json.Marshal(tracksIndexTemplate())
+	if err != nil {
+		log.Fatalf("could not marshal index template: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	// The legacy template API is used as composable templates are unavailable before Elasticsearch 7.8
+	req := esapi.IndicesPutTemplateRequest{
+		Name: tracksTemplateName,
+		Body: bytes.NewReader(body),
+	}
+	resp, err := req.Do(ctx, s.es)
+	if err != nil {
+		return fmt.Errorf("could not install index template: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.IsError() {
+		respBytes, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("could not install index template: status %d (%s)", resp.StatusCode, string(respBytes))
+	}
+	log.Infof("installed elasticsearch index template %s version %d", tracksTemplateName, tracksIndexVersion)
+	return nil
+}
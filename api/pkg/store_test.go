@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/zmb3/spotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// The tracks searched by the query string tests, keyed on Spotify ID
+var queryStringTestLyrics = map[string]string{
+	"versefindtest1": "love will tear us apart again",
+	"versefindtest2": "tell me why i hate mondays",
+	"versefindtest3": "love and hate all through the night",
+	"versefindtest4": "dancing in the dark",
+}
+
+// Opens each track store the query string tests can run against. The Elasticsearch store is only tested if
+// VERSEFIND_TEST_ELASTICSEARCH gives the address of a disposable instance, as the test tracks are written to it
+func openQueryStringTestStores(t *testing.T) map[string]TrackStore {
+	dir, err := ioutil.TempDir("", "versefind")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %s", err.Error())
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	bleveStore, err := NewBleveStore(filepath.Join(dir, "tracks.bleve"))
+	if err != nil {
+		t.Fatalf("could not open bleve store: %s", err.Error())
+	}
+	t.Cleanup(func() { _ = bleveStore.Close() })
+	stores := map[string]TrackStore{"bleve": bleveStore}
+
+	if address := os.Getenv("VERSEFIND_TEST_ELASTICSEARCH"); address != "" {
+		elasticStore, err := NewElasticStore(address)
+		if err != nil {
+			t.Fatalf("could not open elastic store: %s", err.Error())
+		}
+		stores["elastic"] = elasticStore
+	} else {
+		t.Log("VERSEFIND_TEST_ELASTICSEARCH is not set, so only the bleve store is tested")
+	}
+
+	for name, store := range stores {
+		for id, lyrics := range queryStringTestLyrics {
+			track := NewVerseTrack(spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: spotify.ID(id), Name: id}}, LyricsResult{Lyrics: lyrics})
+			if err := store.PutTrack(context.Background(), track); err != nil {
+				t.Fatalf("could not index test track in %s store: %s", name, err.Error())
+			}
+		}
+	}
+	return stores
+}
+
+func TestQueryStringSearch(t *testing.T) {
+	stores := openQueryStringTestStores(t)
+	var ids []string
+	for id := range queryStringTestLyrics {
+		ids = append(ids, id)
+	}
+
+	for _, tc := range []struct {
+		query    string
+		expected []string
+	}{
+		{"love", []string{"versefindtest1", "versefindtest3"}},
+		{"love hate", []string{"versefindtest3"}},
+		{"love AND hate", []string{"versefindtest3"}},
+		{"love OR hate", []string{"versefindtest1", "versefindtest2", "versefindtest3"}},
+		{"love || hate", []string{"versefindtest1", "versefindtest2", "versefindtest3"}},
+		{"(love hate)", []string{"versefindtest3"}},
+		{"(love OR hate) night", []string{"versefindtest3"}},
+		{"dark OR (love apart)", []string{"versefindtest1", "versefindtest4"}},
+		{"love -hate", []string{"versefindtest1"}},
+		{"love AND NOT hate", []string{"versefindtest1"}},
+		{"-love", []string{"versefindtest2", "versefindtest4"}},
+		{`"love will"`, []string{"versefindtest1"}},
+		{"lyrics:(dark OR mondays)", []string{"versefindtest2", "versefindtest4"}},
+		{"lo*", []string{"versefindtest1", "versefindtest3"}},
+	} {
+		for name, store := range stores {
+			results, err := store.Search(context.Background(), TrackSearch{
+				Query:    tc.query,
+				Mode:     SearchModeQuery,
+				Fields:   []string{"lyrics"},
+				TrackIDs: ids,
+				Limit:    10,
+			})
+			if err != nil {
+				t.Errorf("%s store: search for %s failed: %s", name, tc.query, err.Error())
+				continue
+			}
+			var found []string
+			for _, hit := range results.Results {
+				found = append(found, hit.Spotify.ID.String())
+			}
+			sort.Strings(found)
+			if !reflect.DeepEqual(found, tc.expected) {
+				t.Errorf("%s store: search for %s found %v, expected %v", name, tc.query, found, tc.expected)
+			}
+		}
+	}
+}
+
+func TestQueryStringSearchInvalid(t *testing.T) {
+	stores := openQueryStringTestStores(t)
+	for _, query := range []string{"(love", "love)", "love OR", "()", `"love will`} {
+		for name, store := range stores {
+			_, err := store.Search(context.Background(), TrackSearch{Query: query, Mode: SearchModeQuery, Limit: 10})
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("%s store: search for %s gave %v, expected an invalid query error", name, query, err)
+			}
+		}
+	}
+}
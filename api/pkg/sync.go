@@ -0,0 +1,229 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// How often every active user's library is synced in the background. Zero disables background syncs
+	resyncInterval = time.Hour * 6
+	// How often a user's saved tracks are fetched in full rather than incrementally, which retries any which could not
+	// be stored
+	fullSyncInterval = time.Hour * 24
+)
+
+// Sets how often every active user's library is synced in the background, without a browser open. Zero disables
+// background syncs
+func SetResyncInterval(interval time.Duration) {
+	resyncInterval = interval
+}
+
+// Starts syncing the user's library unless a sync is already running, in which case the running sync is joined.
+// Returns a channel which is closed when the sync finishes. 'halt' can stop a sync started by this call early
+func (u *activeUser) StartSync(halt func() bool) <-chan struct{} {
+	u.syncMutex.Lock()
+	defer u.syncMutex.Unlock()
+	if u.syncDone != nil {
+		return u.syncDone
+	}
+	done := make(chan struct{})
+	u.syncDone = done
+	state := u.syncState
+	state.Sources = append([]string{}, u.sources...)
+	go func() {
+		defer close(done)
+		state = u.syncLibrary(state, halt)
+		u.SetProgress(0, 0, "", true)
+		u.syncMutex.Lock()
+		defer u.syncMutex.Unlock()
+		u.syncDone = nil
+		u.syncState = state
+	}()
+	return done
+}
+
+// Fetches the tracks in the user's library which have changed since the sync described by 'state', drops removed
+// tracks from the user's searchable set and indexes new ones. Returns the state from which the next sync continues,
+// which is 'state' itself if the sync was halted
+func (u *activeUser) syncLibrary(state SyncState, halt func() bool) SyncState {
+	// Fetch tracks from the chosen parts of the user's Spotify library
+	client := u.Client()
+	var since *SyncState
+	if time.Since(state.FullSyncedAt) < fullSyncInterval {
+		since = &state
+	}
+	log.Debugf("starting lyric collector (incremental=%t)", since != nil)
+	library := collectLibrary(client, state.Sources, since, halt, func(text string, n, total int) {
+		u.SetProgress(n, total, text, false)
+	})
+	if halt() || u.ReauthRequired() {
+		return state
+	}
+
+	u.reconcileLibrary(library, state.Sources)
+
+	// Only index tracks new to the user
+	var spotifyTracks []spotify.FullTrack
+	for _, track := range library.tracks {
+		if _, ok := u.indexedTracks.Load(track.ID.String()); !ok {
+			spotifyTracks = append(spotifyTracks, track)
+		}
+	}
+
+	// Index lyrics, skipping the lookup for tracks Spotify rates as instrumental
+	instrumentals := DetectInstrumentals(client, spotifyTracks)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var indexedCount int32
+	IndexTracks(ctx, spotifyTracks, instrumentals, func(track spotify.FullTrack, err error) {
+		n := atomic.AddInt32(&indexedCount, 1)
+		// A track whose lookup failed is stored all the same, to be retried in the background, so it joins the user's
+		// tracks and becomes searchable once lyrics are found
+		if errors.Is(err, ErrLookupFailed) {
+			log.Debugf("lyrics lookup for %s will be retried: %s", track.ID, err.Error())
+			err = nil
+		}
+		trackSources := library.sources[track.ID.String()]
+		if err != nil {
+			log.Warnf("could not index lyrics for %s: %s", track.ID, err.Error())
+		} else {
+			u.indexedTracks.Store(track.ID.String(), trackSources)
+			if err := sessions.AddIndexedTrack(u.session, track.ID.String(), trackSources); err != nil {
+				log.Warnf("could not persist indexed track %s: %s", track.ID, err.Error())
+			}
+		}
+		// Tracks are recorded even when halting, as the track store already holds them
+		if halt() {
+			cancel()
+			return
+		}
+		if err == nil {
+			u.MatchSavedSearches(ctx, track.ID.String(), trackSources)
+		}
+		u.SetProgress(int(n), len(spotifyTracks), "Indexing lyrics", false)
+	})
+	if halt() {
+		return state
+	}
+
+	// Continue from the newest saved track next time, provided the saved tracks were fetched
+	if _, ok := library.fetched["saved"]; ok {
+		state.SavedAddedAt = library.savedAddedAt
+		state.SavedTotal = library.savedTotal
+	}
+	if since == nil {
+		state.FullSyncedAt = time.Now()
+	}
+	if err := sessions.SaveSyncState(u.session, state); err != nil {
+		log.Warnf("could not persist sync state: %s", err.Error())
+	}
+	return state
+}
+
+// Brings the library sources of the user's indexed tracks up to date with those just fetched. Sources which were
+// fetched in full replace those previously recorded, so tracks which are no longer in any source of the user's library
+// drop out of their searchable set. Sources which were not fetched, or only fetched incrementally, are kept, unless
+// they are no longer among the 'selected' library sources
+func (u *activeUser) reconcileLibrary(library *libraryTracks, selected []string) {
+	updated := map[string][]TrackSource{}
+	var removed []string
+	u.indexedTracks.Range(func(key, value interface{}) bool {
+		id := key.(string)
+		previous := value.([]TrackSource)
+		current := append([]TrackSource{}, library.sources[id]...)
+		for _, source := range previous {
+			if !isSelectedSource(selected, source) {
+				continue
+			}
+			if full, ok := library.fetched[source.LibrarySource()]; ok && full {
+				continue
+			}
+			if !hasSource(current, source) {
+				current = append(current, source)
+			}
+		}
+		switch {
+		case len(current) == 0:
+			removed = append(removed, id)
+		case !sameSources(previous, current):
+			updated[id] = current
+		}
+		return true
+	})
+
+	for id, trackSources := range updated {
+		u.indexedTracks.Store(id, trackSources)
+	}
+	if err := sessions.AddIndexedTracks(u.session, updated); err != nil {
+		log.Warnf("could not persist track sources: %s", err.Error())
+	}
+	for _, id := range removed {
+		u.indexedTracks.Delete(id)
+	}
+	if len(removed) > 0 {
+		log.Debugf("%d tracks were removed from the library of session %s", len(removed), u.session)
+		if err := sessions.RemoveIndexedTracks(u.session, removed); err != nil {
+			log.Warnf("could not persist removed tracks: %s", err.Error())
+		}
+	}
+}
+
+// Reports whether a track source is in one of the selected library sources
+func isSelectedSource(selected []string, source TrackSource) bool {
+	for _, librarySource := range selected {
+		if librarySource == source.LibrarySource() {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSource(trackSources []TrackSource, source TrackSource) bool {
+	for _, s := range trackSources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether two lists hold the same track sources, in any order
+func sameSources(a, b []TrackSource) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, source := range a {
+		if !hasSource(b, source) {
+			return false
+		}
+	}
+	return true
+}
+
+// Periodically syncs the library of every active user, one at a time, so that their searchable tracks stay current
+// without a browser open
+func resyncSessions() {
+	if resyncInterval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(resyncInterval)
+		var users []*activeUser
+		activeUsers.Range(func(key, value interface{}) bool {
+			users = append(users, value.(*activeUser))
+			return true
+		})
+		log.Infof("syncing the libraries of %d users", len(users))
+		for _, user := range users {
+			if user.ReauthRequired() {
+				continue
+			}
+			<-user.StartSync(func() bool { return user.ReauthRequired() })
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
+	"net/http"
+)
+
+// A token source which transparently refreshes a user's OAuth2 token using its refresh token, writing refreshed
+// tokens back to the user's session
+type sessionTokenSource struct {
+	user *activeUser
+	base oauth2.TokenSource
+}
+
+func (s *sessionTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.base.Token()
+	if refreshTokenRejected(err) {
+		// Spotify rejected the refresh token, so only a fresh login can restore access
+		log.Warnf("could not refresh oauth token for session %s: %s", s.user.session, err.Error())
+		s.user.RequireReauth()
+		return nil, err
+	}
+	if err != nil {
+		// Other failures, such as Spotify being unavailable, leave the session as it is so that the next request
+		// retries the refresh
+		return nil, err
+	}
+	s.user.UpdateToken(token)
+	return token, nil
+}
+
+// Reports whether a token refresh failed because the refresh token was revoked or has expired, as opposed to a
+// transient failure
+func refreshTokenRejected(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) || retrieveErr.Response == nil {
+		return false
+	}
+	if code := retrieveErr.Response.StatusCode; code != http.StatusBadRequest && code != http.StatusUnauthorized {
+		return false
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	return json.Unmarshal(retrieveErr.Body, &body) == nil && body.Error == "invalid_grant"
+}
+
+// Builds a Spotify client for the user which refreshes their OAuth2 token as it expires
+func (u *activeUser) Client() spotify.Client {
+	ts := &sessionTokenSource{user: u, base: oauthConfig.TokenSource(context.Background(), u.Token())}
+	return spotify.NewClient(oauth2.NewClient(context.Background(), ts))
+}
+
+func (u *activeUser) Token() *oauth2.Token {
+	u.tokenMutex.Lock()
+	defer u.tokenMutex.Unlock()
+	return u.token
+}
+
+// Replaces the user's token, persisting it to their session if it has changed
+func (u *activeUser) UpdateToken(token *oauth2.Token) {
+	u.tokenMutex.Lock()
+	defer u.tokenMutex.Unlock()
+	if u.token != nil && u.token.AccessToken == token.AccessToken {
+		return
+	}
+	log.Debugf("oauth token refreshed for session %s", u.session)
+	u.token = token
+	if err := sessions.SaveSession(u.session, token); err != nil {
+		log.Warnf("could not persist refreshed oauth token: %s", err.Error())
+	}
+}
+
+// Marks the user's session as no longer authorized with Spotify and forgets it, so that the frontend is asked to log in
+// again
+func (u *activeUser) RequireReauth() {
+	u.tokenMutex.Lock()
+	u.reauthRequired = true
+	u.tokenMutex.Unlock()
+	activeUsers.Delete(u.session)
+	if err := sessions.DeleteSession(u.session); err != nil {
+		log.Warnf("could not delete unauthorized session: %s", err.Error())
+	}
+}
+
+func (u *activeUser) ReauthRequired() bool {
+	u.tokenMutex.Lock()
+	defer u.tokenMutex.Unlock()
+	return u.reauthRequired
+}
@@ -0,0 +1,219 @@
+package pkg
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2/clientcredentials"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// A reference to a track to be indexed, given either as a Spotify track ID (or URI/URL) or as an artist/title pair
+type TrackRef struct {
+	ID     string `json:"id"`
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+}
+
+func (r TrackRef) String() string {
+	if r.ID != "" {
+		return r.ID
+	}
+	return r.Artist + " - " + r.Title
+}
+
+// Reads a list of track references in the given format ("json" or "csv"). JSON input is an array whose elements are
+// either Spotify ID strings or objects with "id" or "artist" and "title" keys. CSV input must have a header row naming
+// an "id" column or "artist" and "title" columns.
+func ReadTrackRefs(reader io.Reader, format string) ([]TrackRef, error) {
+	var refs []TrackRef
+	switch format {
+	case "json":
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("could not read track list: %w", err)
+		}
+		var elems []json.RawMessage
+		err = json.Unmarshal(data, &elems)
+		if err != nil {
+			return nil, fmt.Errorf("track list is not a JSON array: %w", err)
+		}
+		for idx, elem := range elems {
+			var ref TrackRef
+			if err := json.Unmarshal(elem, &ref.ID); err != nil {
+				if err := json.Unmarshal(elem, &ref); err != nil {
+					return nil, fmt.Errorf("track list element %d is neither a string nor a track object: %w", idx, err)
+				}
+			}
+			refs = append(refs, ref)
+		}
+	case "csv":
+		rows, err := csv.NewReader(reader).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("could not read track list: %w", err)
+		}
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		columns := map[string]int{}
+		for idx, name := range rows[0] {
+			columns[strings.ToLower(strings.TrimSpace(name))] = idx
+		}
+		idCol, hasID := columns["id"]
+		artistCol, hasArtist := columns["artist"]
+		titleCol, hasTitle := columns["title"]
+		if !hasID && !(hasArtist && hasTitle) {
+			return nil, errors.New(`track list header must name an "id" column or "artist" and "title" columns`)
+		}
+		for _, row := range rows[1:] {
+			var ref TrackRef
+			if hasID {
+				ref.ID = row[idCol]
+			}
+			if hasArtist && hasTitle {
+				ref.Artist = row[artistCol]
+				ref.Title = row[titleCol]
+			}
+			refs = append(refs, ref)
+		}
+	default:
+		return nil, fmt.Errorf("unknown track list format %s", format)
+	}
+
+	for idx := range refs {
+		refs[idx].ID = NormalizeSpotifyID("track", refs[idx].ID)
+		if refs[idx].ID == "" && (refs[idx].Artist == "" || refs[idx].Title == "") {
+			return nil, fmt.Errorf("track list entry %d has neither an id nor an artist and title", idx+1)
+		}
+	}
+	return refs, nil
+}
+
+// Accepts a bare Spotify ID, a URI such as spotify:track:<id> or an open.spotify.com URL for an item of the given kind,
+// such as "track" or "playlist", and returns the bare ID
+func NormalizeSpotifyID(kind, id string) string {
+	id = strings.TrimSpace(id)
+	if prefix := "spotify:" + kind + ":"; strings.HasPrefix(id, prefix) {
+		return strings.TrimPrefix(id, prefix)
+	}
+	if u, err := url.Parse(id); err == nil && u.Host != "" {
+		return strings.TrimPrefix(u.Path, "/"+kind+"/")
+	}
+	return id
+}
+
+// Reports whether 'id' has the form of a Spotify ID, 22 base62 characters. Spotify rejects a whole request for several
+// tracks if any of their IDs is malformed
+func isSpotifyID(id string) bool {
+	if len(id) != 22 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Looks up the full Spotify track for each reference. The returned slice is parallel to 'refs', with nil entries for
+// references which could not be found on Spotify, including those whose ID is malformed
+func ResolveTracks(client spotify.Client, refs []TrackRef) ([]*spotify.FullTrack, error) {
+	tracks := make([]*spotify.FullTrack, len(refs))
+
+	// Look up tracks given by ID in batches, as allowed by the Spotify API
+	var batchIdxs []int
+	var batchIDs []spotify.ID
+	flush := func() error {
+		if len(batchIDs) == 0 {
+			return nil
+		}
+		found, err := client.GetTracks(batchIDs...)
+		if err != nil {
+			return fmt.Errorf("could not fetch tracks from spotify: %w", err)
+		}
+		// Spotify gives null for tracks it does not know
+		for idx, track := range found {
+			if idx < len(batchIdxs) {
+				tracks[batchIdxs[idx]] = track
+			}
+		}
+		batchIdxs, batchIDs = nil, nil
+		return nil
+	}
+	for idx, ref := range refs {
+		if !isSpotifyID(ref.ID) {
+			continue
+		}
+		batchIdxs = append(batchIdxs, idx)
+		batchIDs = append(batchIDs, spotify.ID(ref.ID))
+		if len(batchIDs) == 50 {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	// Search for tracks given by artist and title, taking Spotify's best match
+	for idx, ref := range refs {
+		if ref.ID != "" {
+			continue
+		}
+		limit := 1
+		query := fmt.Sprintf("track:%s artist:%s", ref.Title, ref.Artist)
+		result, err := client.SearchOpt(query, spotify.SearchTypeTrack, &spotify.Options{Limit: &limit})
+		if err != nil {
+			return nil, fmt.Errorf("could not search spotify for %s: %w", ref, err)
+		}
+		if result.Tracks != nil && len(result.Tracks.Tracks) > 0 {
+			tracks[idx] = &result.Tracks.Tracks[0]
+		}
+	}
+	return tracks, nil
+}
+
+// Creates a Spotify client authorized with Versefind's own client credentials rather than a user's, for use where no
+// user session is available
+func NewAppClient(ctx context.Context) (spotify.Client, error) {
+	if err := loadOAuthCredentials(); err != nil {
+		return spotify.Client{}, err
+	}
+	config := &clientcredentials.Config{
+		ClientID:     oauthClientID,
+		ClientSecret: oauthSecret,
+		TokenURL:     spotify.TokenURL,
+	}
+	if _, err := config.Token(ctx); err != nil {
+		return spotify.Client{}, fmt.Errorf("could not authenticate with spotify: %w", err)
+	}
+	return spotify.NewClient(config.Client(ctx)), nil
+}
+
+// Reads the Spotify OAuth2 client credentials from the environment
+func loadOAuthCredentials() error {
+	oauthClientID = os.Getenv("OAUTH_CLIENTID")
+	oauthSecret = os.Getenv("OAUTH_SECRET")
+	if oauthClientID == "" || oauthSecret == "" {
+		return errors.New("Spotify OAuth2 credentials are required. Specify with OAUTH_CLIENTID and OAUTH_SECRET.")
+	}
+	return nil
+}
+
+// Formats a track as "Artist, Artist - Title" for display
+func TrackDisplayName(track spotify.FullTrack) string {
+	var artistNames []string
+	for _, artist := range track.Artists {
+		artistNames = append(artistNames, artist.Name)
+	}
+	return strings.Join(artistNames, ", ") + " - " + track.Name
+}